@@ -12,6 +12,13 @@ func writeForbidden(w http.ResponseWriter) {
 	w.Write(b)
 }
 
+func writeBadRequest(err error, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	ret := map[string]string{"error": err.Error()}
+	b, _ := json.Marshal(ret)
+	w.Write(b)
+}
+
 func writeInternalServerError(err error, w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	ret := map[string]string{"error": err.Error()}
@@ -8,22 +8,44 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"minivmm"
 )
 
-func parseForwardBody(body io.ReadCloser) *minivmm.ForwardMetaData {
+type forward struct {
+	minivmm.ForwardMetaData
+	// TTL is the lifetime of the forward in seconds. It never expires if it's 0.
+	TTL *int `json:"ttl"`
+	// Description shadows the embedded one to distinguish the empty description from the omitted one.
+	Description *string `json:"description"`
+}
+
+func parseForwardBody(body io.ReadCloser) *forward {
 	defer body.Close()
 
 	buf := new(bytes.Buffer)
 	io.Copy(buf, body)
 
-	var f minivmm.ForwardMetaData
+	var f forward
 	json.Unmarshal(buf.Bytes(), &f)
 
 	return &f
 }
 
+type forwardStatus struct {
+	*minivmm.ForwardMetaData
+	Stats  *minivmm.ForwardStats  `json:"stats"`
+	Health *minivmm.ForwardHealth `json:"health"`
+}
+
+func getForwardExpiresAt(ttl int) string {
+	if ttl <= 0 {
+		return ""
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second).Format(time.RFC3339)
+}
+
 // HandleForwards handles forward resource request.
 func HandleForwards(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
@@ -34,6 +56,10 @@ func HandleForwards(w http.ResponseWriter, r *http.Request) {
 		CreateForward(w, r)
 		return
 	}
+	if r.Method == http.MethodPatch {
+		UpdateForward(w, r)
+		return
+	}
 	if r.Method == http.MethodDelete {
 		DeleteForward(w, r)
 		return
@@ -51,26 +77,53 @@ func ListForwards(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// filter by owner
-	ownedForwards := []*minivmm.ForwardMetaData{}
+	ownedForwards := []*forwardStatus{}
+	total := &minivmm.ForwardStats{}
 	for i := 0; i < len(forwards); i++ {
 		if forwards[i].Owner != minivmm.GetUserName(r) {
 			continue
 		}
-		ownedForwards = append(ownedForwards, forwards[i])
+		stats := minivmm.GetForwardStats(forwards[i].Proto, forwards[i].FromPort)
+		if stats != nil {
+			total.Connections += stats.Connections
+			total.ActiveConnections += stats.ActiveConnections
+			total.BytesIn += stats.BytesIn
+			total.BytesOut += stats.BytesOut
+			total.Errors += stats.Errors
+		}
+		health := minivmm.GetForwardHealth(forwards[i].Proto, forwards[i].FromPort)
+		ownedForwards = append(ownedForwards, &forwardStatus{forwards[i], stats, health})
 	}
 
 	// reponse
-	ret := map[string][]*minivmm.ForwardMetaData{"forwards": ownedForwards}
+	ret := map[string]interface{}{"forwards": ownedForwards, "total": total}
 	b, _ := json.Marshal(ret)
 	w.Write(b)
 }
 
 // CreateForward sets up forwarding and writes its metadata.
 func CreateForward(w http.ResponseWriter, r *http.Request) {
-	f := parseForwardBody(r.Body)
+	req := parseForwardBody(r.Body)
+	f := &req.ForwardMetaData
 	f.Owner = minivmm.GetUserName(r)
+	f.ExpiresAt = ""
+	if req.TTL != nil {
+		f.ExpiresAt = getForwardExpiresAt(*req.TTL)
+	}
+	if req.Description != nil {
+		f.Description = *req.Description
+	}
 
-	if f.FromPort == "" {
+	err := restrictVMOperationByOwner(w, r, f.ToName)
+	if err != nil {
+		return
+	}
+
+	if f.Type == minivmm.ForwardTypeHTTP || f.Type == minivmm.ForwardTypeTLS {
+		if f.FromPort == "" {
+			f.FromPort = minivmm.DefaultHTTPForwardHost(f.ToName)
+		}
+	} else if f.FromPort == "" {
 		rangeMin, rangeMax := portRangePerUser(minivmm.GetUserName(r))
 		port, err := minivmm.GetRandomForwardPort(f.Proto, rangeMin, rangeMax)
 		if err != nil {
@@ -82,7 +135,7 @@ func CreateForward(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(f)
 
-	err := minivmm.StartForward(f.Proto, f.FromPort, f.ToName, f.ToPort)
+	err = minivmm.StartForward(f)
 	if err != nil {
 		writeInternalServerError(err, w)
 		return
@@ -95,9 +148,61 @@ func CreateForward(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// UpdateForward changes the destination, description, lifetime or health check of the forward.
+func UpdateForward(w http.ResponseWriter, r *http.Request) {
+	req := parseForwardBody(r.Body)
+
+	err := restrictForwardOperationByOwner(w, r, req.Proto, req.FromPort)
+	if err != nil {
+		return
+	}
+
+	old, err := minivmm.ReadForwardFile(req.Proto, req.FromPort)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+	f := *old
+	if req.ToName != "" {
+		err = restrictVMOperationByOwner(w, r, req.ToName)
+		if err != nil {
+			return
+		}
+		f.ToName = req.ToName
+	}
+	if req.ToPort != "" {
+		f.ToPort = req.ToPort
+	}
+	if req.Description != nil {
+		f.Description = *req.Description
+	}
+	if req.TTL != nil {
+		f.ExpiresAt = getForwardExpiresAt(*req.TTL)
+	}
+	if req.HealthCheck != nil {
+		// the empty type disables the health check
+		f.HealthCheck = req.HealthCheck
+		if req.HealthCheck.Type == "" {
+			f.HealthCheck = nil
+		}
+	}
+
+	log.Println(f)
+
+	err = minivmm.UpdateForward(old, &f)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(f)
+	w.Write(b)
+}
+
 // DeleteForward shuts down forwarding and removes its metadata.
 func DeleteForward(w http.ResponseWriter, r *http.Request) {
-	f := parseForwardBody(r.Body)
+	req := parseForwardBody(r.Body)
+	f := &req.ForwardMetaData
 
 	err := restrictForwardOperationByOwner(w, r, f.Proto, f.FromPort)
 	if err != nil {
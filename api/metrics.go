@@ -11,11 +11,19 @@ import (
 
 const promNamespace = "minivmm"
 
+var forwardLabels = []string{"proto", "from_port", "to_name", "owner"}
+
 type minivmmExporter struct {
 	cpuCores  *prometheus.GaugeVec
 	memBytes  *prometheus.GaugeVec
 	diskBytes prometheus.Gauge
 	numVM     *prometheus.GaugeVec
+
+	forwardConns       *prometheus.Desc
+	forwardActiveConns *prometheus.Desc
+	forwardBytes       *prometheus.Desc
+	forwardErrors      *prometheus.Desc
+	forwardUp          *prometheus.Desc
 }
 
 func NewMinivmmExporter() *minivmmExporter {
@@ -51,6 +59,31 @@ func NewMinivmmExporter() *minivmmExporter {
 			},
 			[]string{"state"},
 		),
+		forwardConns: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "forward", "connections_total"),
+			"the number of connections accepted by the forward",
+			forwardLabels, nil,
+		),
+		forwardActiveConns: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "forward", "active_connections"),
+			"the number of active connections of the forward",
+			forwardLabels, nil,
+		),
+		forwardBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "forward", "bytes_total"),
+			"the traffic of the forward, 'in' is from clients to the VM",
+			append(forwardLabels, "direction"), nil,
+		),
+		forwardErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "forward", "errors_total"),
+			"the number of failed or rejected connections of the forward",
+			forwardLabels, nil,
+		),
+		forwardUp: prometheus.NewDesc(
+			prometheus.BuildFQName(promNamespace, "forward", "up"),
+			"the result of the health check of the forward destination, 1 if it's healthy",
+			forwardLabels, nil,
+		),
 	}
 }
 
@@ -59,6 +92,11 @@ func (e minivmmExporter) Describe(ch chan<- *prometheus.Desc) {
 	e.memBytes.Describe(ch)
 	ch <- e.diskBytes.Desc()
 	e.numVM.Describe(ch)
+	ch <- e.forwardConns
+	ch <- e.forwardActiveConns
+	ch <- e.forwardBytes
+	ch <- e.forwardErrors
+	ch <- e.forwardUp
 }
 
 func (e *minivmmExporter) Collect(ch chan<- prometheus.Metric) {
@@ -79,6 +117,39 @@ func (e *minivmmExporter) Collect(ch chan<- prometheus.Metric) {
 	e.memBytes.Collect(ch)
 	ch <- prometheus.MustNewConstMetric(e.diskBytes.Desc(), prometheus.GaugeValue, float64(m.DiskBytes))
 	e.numVM.Collect(ch)
+
+	e.collectForwards(ch)
+}
+
+func (e *minivmmExporter) collectForwards(ch chan<- prometheus.Metric) {
+	forwards, err := minivmm.ReadAllForwardFiles()
+	if err != nil {
+		log.Printf("failed to get forwards; %v", err)
+		return
+	}
+
+	for _, f := range forwards {
+		s := minivmm.GetForwardStats(f.Proto, f.FromPort)
+		if s == nil {
+			continue
+		}
+		labels := []string{f.Proto, f.FromPort, f.ToName, f.Owner}
+		ch <- prometheus.MustNewConstMetric(e.forwardConns, prometheus.CounterValue, float64(s.Connections), labels...)
+		ch <- prometheus.MustNewConstMetric(e.forwardActiveConns, prometheus.GaugeValue, float64(s.ActiveConnections), labels...)
+		ch <- prometheus.MustNewConstMetric(e.forwardBytes, prometheus.CounterValue, float64(s.BytesIn), append(labels, "in")...)
+		ch <- prometheus.MustNewConstMetric(e.forwardBytes, prometheus.CounterValue, float64(s.BytesOut), append(labels, "out")...)
+		ch <- prometheus.MustNewConstMetric(e.forwardErrors, prometheus.CounterValue, float64(s.Errors), labels...)
+
+		h := minivmm.GetForwardHealth(f.Proto, f.FromPort)
+		if h == nil || h.Status == minivmm.ForwardHealthUnknown {
+			continue
+		}
+		up := 0.0
+		if h.Status == minivmm.ForwardHealthUp {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.forwardUp, prometheus.GaugeValue, up, labels...)
+	}
 }
 
 // GetMetricsHandler returns the prometheus metrics handler.
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"minivmm"
+)
+
+func parseNetworkBody(body io.ReadCloser) *minivmm.NetworkMetaData {
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, body)
+
+	var nw minivmm.NetworkMetaData
+	json.Unmarshal(buf.Bytes(), &nw)
+
+	return &nw
+}
+
+// HandleNetworks handles network resource request.
+func HandleNetworks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ListNetworks(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		CreateNetwork(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		DeleteNetwork(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// ListNetworks returns a list of networks.
+func ListNetworks(w http.ResponseWriter, r *http.Request) {
+	networks, err := minivmm.ListNetworks()
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ret := []*minivmm.NetworkMetaData{}
+	for _, nw := range networks {
+		// private networks are only visible to their owner
+		if nw.Private && nw.Owner != minivmm.GetUserName(r) {
+			continue
+		}
+		ret = append(ret, nw)
+	}
+	b, _ := json.Marshal(map[string][]*minivmm.NetworkMetaData{"networks": ret})
+	w.Write(b)
+}
+
+// CreateNetwork creates a network and writes its metadata.
+func CreateNetwork(w http.ResponseWriter, r *http.Request) {
+	nw := parseNetworkBody(r.Body)
+	nw.Owner = minivmm.GetUserName(r)
+
+	log.Println(nw)
+
+	err := minivmm.CreateNetwork(nw)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(nw)
+	w.Write(b)
+}
+
+// DeleteNetwork removes a network.
+func DeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	name := paths[len(paths)-1]
+
+	err := restrictNetworkOperationByOwner(w, r, name)
+	if err != nil {
+		return
+	}
+
+	err = minivmm.RemoveNetwork(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restrictNetworkOperationByOwner(w http.ResponseWriter, r *http.Request, name string) error {
+	metaData, err := minivmm.GetNetwork(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return err
+	}
+
+	if metaData.Owner != minivmm.GetUserName(r) {
+		writeForbidden(w)
+		return fmt.Errorf("forbidden")
+	}
+
+	return nil
+}
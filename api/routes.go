@@ -14,6 +14,12 @@ func RegisterHandlers(mux *http.ServeMux) {
 	registerWithAuth(mux, prefix+"/vms/", HandleVMs)
 	registerWithAuth(mux, prefix+"/forwards", HandleForwards)
 	registerWithAuth(mux, prefix+"/images", HandleImages)
+	registerWithAuth(mux, prefix+"/networks", HandleNetworks)
+	registerWithAuth(mux, prefix+"/networks/", HandleNetworks)
+	registerWithAuth(mux, prefix+"/security-groups", HandleSecurityGroups)
+	registerWithAuth(mux, prefix+"/security-groups/", HandleSecurityGroups)
+	registerWithAuth(mux, prefix+"/ssh-keys", HandleSSHKeys)
+	registerWithAuth(mux, prefix+"/ssh-keys/", HandleSSHKeys)
 
 	mux.HandleFunc(prefix+"/login", HandleOIDCCallback)
 
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"minivmm"
+)
+
+func parseSecurityGroupBody(body io.ReadCloser) *minivmm.SecurityGroupMetaData {
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, body)
+
+	var sg minivmm.SecurityGroupMetaData
+	json.Unmarshal(buf.Bytes(), &sg)
+
+	return &sg
+}
+
+// HandleSecurityGroups handles security group resource request.
+func HandleSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ListSecurityGroups(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		CreateSecurityGroup(w, r)
+		return
+	}
+	if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		UpdateSecurityGroup(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		DeleteSecurityGroup(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// ListSecurityGroups returns a list of security groups owned by the user.
+func ListSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	sgs, err := minivmm.ListSecurityGroups()
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ret := []*minivmm.SecurityGroupMetaData{}
+	for _, sg := range sgs {
+		if sg.Owner != minivmm.GetUserName(r) {
+			continue
+		}
+		ret = append(ret, sg)
+	}
+	b, _ := json.Marshal(map[string][]*minivmm.SecurityGroupMetaData{"security_groups": ret})
+	w.Write(b)
+}
+
+// CreateSecurityGroup creates a security group and writes its metadata.
+func CreateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	sg := parseSecurityGroupBody(r.Body)
+	sg.Owner = minivmm.GetUserName(r)
+
+	log.Println(sg)
+
+	err := minivmm.CreateSecurityGroup(sg)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(sg)
+	w.Write(b)
+}
+
+// UpdateSecurityGroup replaces the rules of a security group.
+func UpdateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	name := paths[len(paths)-1]
+
+	err := restrictSecurityGroupOperationByOwner(w, r, name)
+	if err != nil {
+		return
+	}
+
+	sg := parseSecurityGroupBody(r.Body)
+	sg.Name = name
+	sg.Owner = minivmm.GetUserName(r)
+
+	err = minivmm.UpdateSecurityGroup(sg)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(sg)
+	w.Write(b)
+}
+
+// DeleteSecurityGroup removes a security group.
+func DeleteSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	name := paths[len(paths)-1]
+
+	err := restrictSecurityGroupOperationByOwner(w, r, name)
+	if err != nil {
+		return
+	}
+
+	err = minivmm.RemoveSecurityGroup(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restrictSecurityGroupOperationByOwner(w http.ResponseWriter, r *http.Request, name string) error {
+	sg, err := minivmm.GetSecurityGroup(name)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return err
+	}
+
+	if sg.Owner != minivmm.GetUserName(r) {
+		writeForbidden(w)
+		return fmt.Errorf("forbidden")
+	}
+
+	return nil
+}
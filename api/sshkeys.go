@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"minivmm"
+)
+
+func parseSSHKeyBody(body io.ReadCloser) *minivmm.SSHKeyMetaData {
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, body)
+
+	var k minivmm.SSHKeyMetaData
+	json.Unmarshal(buf.Bytes(), &k)
+
+	return &k
+}
+
+// HandleSSHKeys handles ssh public key resource request.
+func HandleSSHKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ListSSHKeys(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		CreateSSHKey(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		DeleteSSHKey(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// ListSSHKeys returns a list of ssh public keys registered by the user.
+func ListSSHKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := minivmm.ListSSHKeys()
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	ret := []*minivmm.SSHKeyMetaData{}
+	for _, k := range keys {
+		if k.Owner != minivmm.GetUserName(r) {
+			continue
+		}
+		ret = append(ret, k)
+	}
+	b, _ := json.Marshal(map[string][]*minivmm.SSHKeyMetaData{"ssh_keys": ret})
+	w.Write(b)
+}
+
+// CreateSSHKey registers a ssh public key to log in to the ssh bastion.
+func CreateSSHKey(w http.ResponseWriter, r *http.Request) {
+	k := parseSSHKeyBody(r.Body)
+	k.Owner = minivmm.GetUserName(r)
+
+	log.Println(k)
+
+	err := minivmm.AddSSHKey(k)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(k)
+	w.Write(b)
+}
+
+// DeleteSSHKey unregisters a ssh public key.
+func DeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	id := paths[len(paths)-1]
+
+	err := restrictSSHKeyOperationByOwner(w, r, id)
+	if err != nil {
+		return
+	}
+
+	err = minivmm.RemoveSSHKey(id)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restrictSSHKeyOperationByOwner(w http.ResponseWriter, r *http.Request, id string) error {
+	k, err := minivmm.GetSSHKey(id)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return err
+	}
+
+	if k.Owner != minivmm.GetUserName(r) {
+		writeForbidden(w)
+		return fmt.Errorf("forbidden")
+	}
+
+	return nil
+}
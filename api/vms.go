@@ -18,22 +18,30 @@ import (
 var (
 	updateVMAPI    = regexp.MustCompile(`^/api/v1/vms/[^/]+$`)
 	extraVolumeAPI = regexp.MustCompile(`^/api/v1/vms/[^/]+/volumes.*$`)
+	nicAPI         = regexp.MustCompile(`^/api/v1/vms/[^/]+/nics.*$`)
+	consoleLogAPI  = regexp.MustCompile(`^/api/v1/vms/[^/]+/console-log(\?.*)?$`)
+	consoleAPI     = regexp.MustCompile(`^/api/v1/vms/[^/]+/console$`)
+	screenshotAPI  = regexp.MustCompile(`^/api/v1/vms/[^/]+/screenshot$`)
+	keysAPI        = regexp.MustCompile(`^/api/v1/vms/[^/]+/keys$`)
 )
 
 type vm struct {
-	Name         string        `json:"name"`
-	Status       string        `json:"status"`
-	Owner        string        `json:"owner"`
-	Hypervisor   string        `json:"hypervisor"`
-	Image        string        `json:"image"`
-	IP           string        `json:"ip"`
-	CPU          string        `json:"cpu"`
-	Memory       string        `json:"memory"`
-	Disk         string        `json:"disk"`
-	Tag          string        `json:"tag"`
-	Lock         string        `json:"lock"`
-	UserData     string        `json:"user_data"`
-	ExtraVolumes []extraVolume `json:"extra_volumes"`
+	Name           string        `json:"name"`
+	Status         string        `json:"status"`
+	Owner          string        `json:"owner"`
+	Hypervisor     string        `json:"hypervisor"`
+	Image          string        `json:"image"`
+	IP             string        `json:"ip"`
+	IPv6           string        `json:"ipv6"`
+	CPU            string        `json:"cpu"`
+	Memory         string        `json:"memory"`
+	Disk           string        `json:"disk"`
+	Tag            string        `json:"tag"`
+	Lock           string        `json:"lock"`
+	UserData       string        `json:"user_data"`
+	ExtraVolumes   []extraVolume `json:"extra_volumes"`
+	NICs           []nic         `json:"nics"`
+	SecurityGroups []string      `json:"security_groups"`
 }
 
 type extraVolume struct {
@@ -41,6 +49,21 @@ type extraVolume struct {
 	Size string `json:"size"`
 }
 
+type nic struct {
+	ID         string            `json:"id"`
+	Network    string            `json:"network"`
+	Model      string            `json:"model"`
+	MacAddress string            `json:"mac_address"`
+	IP         string            `json:"ip"`
+	IPv6       string            `json:"ipv6"`
+	Limits     minivmm.NICLimits `json:"limits"`
+}
+
+type keys struct {
+	Keys     []string `json:"keys"`
+	HoldTime int      `json:"hold_time"`
+}
+
 // HandleVMs handles virtual machine resource request.
 func HandleVMs(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost && extraVolumeAPI.MatchString(r.URL.String()) {
@@ -51,6 +74,34 @@ func HandleVMs(w http.ResponseWriter, r *http.Request) {
 		DeleteVolume(w, r)
 		return
 	}
+	if r.Method == http.MethodPost && nicAPI.MatchString(r.URL.String()) {
+		CreateNIC(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete && nicAPI.MatchString(r.URL.String()) {
+		DeleteNIC(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch && nicAPI.MatchString(r.URL.String()) {
+		UpdateNIC(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && consoleLogAPI.MatchString(r.URL.String()) {
+		GetConsoleLog(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && consoleAPI.MatchString(r.URL.String()) {
+		CreateConsoleToken(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && screenshotAPI.MatchString(r.URL.String()) {
+		GetScreenshot(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && keysAPI.MatchString(r.URL.String()) {
+		SendKeys(w, r)
+		return
+	}
 
 	if r.Method == http.MethodGet {
 		ListVMs(w, r)
@@ -92,19 +143,26 @@ func ListVMs(w http.ResponseWriter, r *http.Request) {
 				ev = append(ev, extraVolume{vol.Name, vol.Size})
 			}
 		}
+		nics := []nic{}
+		for _, n := range metaData.NICs {
+			nics = append(nics, nic{n.ID, n.Network, n.Model, n.MacAddress, n.IPAddress, n.IPv6Address, n.Limits})
+		}
 		vm := vm{
-			Name:         metaData.Name,
-			Status:       metaData.Status,
-			Owner:        metaData.Owner,
-			Hypervisor:   hostname,
-			Image:        metaData.Image,
-			IP:           metaData.IPAddress,
-			CPU:          metaData.CPU,
-			Memory:       metaData.Memory,
-			Disk:         metaData.Disk,
-			Lock:         strconv.FormatBool(metaData.Lock),
-			Tag:          metaData.Tag,
-			ExtraVolumes: ev,
+			Name:           metaData.Name,
+			Status:         metaData.Status,
+			Owner:          metaData.Owner,
+			Hypervisor:     hostname,
+			Image:          metaData.Image,
+			IP:             metaData.IPAddress,
+			IPv6:           metaData.IPv6Address,
+			CPU:            metaData.CPU,
+			Memory:         metaData.Memory,
+			Disk:           metaData.Disk,
+			Lock:           strconv.FormatBool(metaData.Lock),
+			Tag:            metaData.Tag,
+			ExtraVolumes:   ev,
+			NICs:           nics,
+			SecurityGroups: metaData.SecurityGroups,
 		}
 		vms = append(vms, &vm)
 	}
@@ -125,7 +183,12 @@ func CreateVM(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal(buf.Bytes(), &v)
 	fmt.Printf("%v\n", v)
 
-	metaData, err := minivmm.CreateVM(v.Name, minivmm.GetUserName(r), v.Image, v.CPU, v.Memory, v.Disk, v.UserData, v.Tag)
+	nics := []minivmm.NIC{}
+	for _, n := range v.NICs {
+		nics = append(nics, minivmm.NIC{Network: n.Network, Model: n.Model, MacAddress: n.MacAddress, Limits: n.Limits})
+	}
+
+	metaData, err := minivmm.CreateVM(v.Name, minivmm.GetUserName(r), v.Image, v.CPU, v.Memory, v.Disk, v.UserData, v.Tag, nics, v.SecurityGroups)
 	if err != nil {
 		writeInternalServerError(err, w)
 		return
@@ -194,6 +257,17 @@ func UpdateVM(w http.ResponseWriter, r *http.Request) {
 		b, _ := json.Marshal(metaData)
 		w.Write(b)
 	}
+
+	if v.SecurityGroups != nil {
+		metaData, err := minivmm.SetVMSecurityGroups(vmName, v.SecurityGroups)
+		if err != nil {
+			writeInternalServerError(err, w)
+			return
+		}
+
+		b, _ := json.Marshal(metaData)
+		w.Write(b)
+	}
 }
 
 // RemoveVM remove VM
@@ -308,3 +382,207 @@ func DeleteVolume(w http.ResponseWriter, r *http.Request) {
 	b, _ := json.Marshal(metaData)
 	w.Write(b)
 }
+
+// CreateNIC adds a new NIC to the VM.
+func CreateNIC(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, r.Body)
+
+	var n nic
+	json.Unmarshal(buf.Bytes(), &n)
+	fmt.Printf("%v\n", n)
+
+	metaData, err := minivmm.AddNIC(vmName, minivmm.NIC{Network: n.Network, Model: n.Model, MacAddress: n.MacAddress, Limits: n.Limits})
+
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// UpdateNIC updates the rate limits of the NIC.
+func UpdateNIC(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	nicID := paths[len(paths)-1]
+	vmName := paths[len(paths)-3]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	buf := new(bytes.Buffer)
+	io.Copy(buf, r.Body)
+
+	var n nic
+	json.Unmarshal(buf.Bytes(), &n)
+	fmt.Printf("%v\n", n)
+
+	metaData, err := minivmm.SetNICLimits(vmName, nicID, n.Limits)
+
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// DeleteNIC removes a NIC from the VM.
+func DeleteNIC(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	nicID := paths[len(paths)-1]
+	vmName := paths[len(paths)-3]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	metaData, err := minivmm.RemoveNIC(vmName, nicID)
+
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(metaData)
+	w.Write(b)
+}
+
+// GetConsoleLog returns the serial console output of the VM.
+// The query parameter `tail` limits the number of lines,
+// and `since` and `generation` are the offset and generation returned by the previous call.
+func GetConsoleLog(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.Path, "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	since := int64(-1)
+	if s := r.URL.Query().Get("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			writeBadRequest(fmt.Errorf("invalid query parameter 'since': %s", s), w)
+			return
+		}
+	}
+	generation := int64(-1)
+	if s := r.URL.Query().Get("generation"); s != "" {
+		generation, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || generation < 0 {
+			writeBadRequest(fmt.Errorf("invalid query parameter 'generation': %s", s), w)
+			return
+		}
+	}
+	tail := 0
+	if s := r.URL.Query().Get("tail"); s != "" {
+		tail, err = strconv.Atoi(s)
+		if err != nil || tail < 0 {
+			writeBadRequest(fmt.Errorf("invalid query parameter 'tail': %s", s), w)
+			return
+		}
+	}
+
+	consoleLog, err := minivmm.GetConsoleLog(vmName, since, generation, tail)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(consoleLog)
+	w.Write(b)
+}
+
+// CreateConsoleToken issues a single-use token to connect to the console of the VM via websocket.
+func CreateConsoleToken(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	token, err := minivmm.IssueConsoleToken(vmName)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(token)
+	w.Write(b)
+}
+
+// GetScreenshot returns the screen of the VM as a PNG image.
+func GetScreenshot(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	b, err := minivmm.GetScreenshot(vmName)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+}
+
+// SendKeys sends the key combination to the VM.
+func SendKeys(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(r.URL.String(), "/")
+	vmName := paths[len(paths)-2]
+
+	err := restrictVMOperationByOwner(w, r, vmName)
+	if err != nil {
+		return
+	}
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(r.Body)
+	k := &keys{}
+	err = json.Unmarshal(body.Bytes(), k)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+	err = minivmm.ValidateKeys(k.Keys)
+	if err != nil {
+		writeBadRequest(err, w)
+		return
+	}
+
+	err = minivmm.SendKeys(vmName, k.Keys, k.HoldTime)
+	if err != nil {
+		writeInternalServerError(err, w)
+		return
+	}
+
+	b, _ := json.Marshal(k)
+	w.Write(b)
+}
@@ -0,0 +1,268 @@
+package minivmm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NetworkModeBridge attaches VM taps to the existing host bridge specified by HostInterface.
+	NetworkModeBridge = "bridge"
+	// NetworkModeMacvtap attaches VMs to the physical host NIC specified by HostInterface via macvtap.
+	NetworkModeMacvtap = "macvtap"
+
+	qgaSocketFileName    = "qga.socket"
+	neighborPollInterval = 10 * time.Second
+)
+
+// isBridgedNetwork returns true if VMs on the network are connected to the host LAN directly.
+// Bridged networks have no bridge in netns, DHCP/RA servers or NAT rules.
+func isBridgedNetwork(nw *NetworkMetaData) bool {
+	return nw.Mode == NetworkModeBridge || nw.Mode == NetworkModeMacvtap
+}
+
+func validateBridgedNetwork(nw *NetworkMetaData) error {
+	if nw.HostInterface == "" {
+		return fmt.Errorf("host interface is required for '%s' mode", nw.Mode)
+	}
+	if nw.NAT || nw.Isolated || nw.Private {
+		return fmt.Errorf("'%s' mode network cannot enable NAT, isolated or private", nw.Mode)
+	}
+	if nw.CIDR6 != "" || nw.DHCPStart != "" || nw.DHCPEnd != "" {
+		return errors.New("IPv6 prefix and DHCP range are given by the host LAN in bridged mode")
+	}
+	if _, err := net.InterfaceByName(nw.HostInterface); err != nil {
+		return fmt.Errorf("host interface '%s' not found", nw.HostInterface)
+	}
+	if nw.Mode == NetworkModeBridge && !exists(filepath.Join("/sys/class/net", nw.HostInterface, "bridge")) {
+		return fmt.Errorf("host interface '%s' is not a bridge", nw.HostInterface)
+	}
+	return nil
+}
+
+func getQGASocketPath(name string) string {
+	return filepath.Join(C.VMDir, name, qgaSocketFileName)
+}
+
+// prepareMacvtap creates the macvtap interface for the NIC and returns its tap device opened.
+func prepareMacvtap(ifName, parent, macAddr string) (*os.File, error) {
+	// the interface is kept while the VM is stopped
+	ExecsIgnoreErr([][]string{
+		{"sudo", "ip", "link", "add", "link", parent, "name", ifName, "type", "macvtap", "mode", "bridge"},
+	})
+	err := Execs([][]string{
+		{"sudo", "ip", "link", "set", "dev", ifName, "address", macAddr},
+		{"sudo", "ip", "link", "set", "dev", ifName, "up"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifName, "ifindex"))
+	if err != nil {
+		return nil, err
+	}
+	devPath := "/dev/tap" + strings.TrimSpace(string(b))
+
+	// the device node is created by udev asynchronously
+	for retryCount := 0; ; retryCount++ {
+		err = Execs([][]string{
+			{"sudo", "chown", strconv.Itoa(os.Getuid()), devPath},
+		})
+		if err == nil {
+			break
+		}
+		if retryCount > 10 {
+			return nil, errors.Wrap(err, "macvtap device not found")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return os.OpenFile(devPath, os.O_RDWR, 0)
+}
+
+// WatchBridgedIPAddress learns the addresses of VMs on bridged networks, which are leased by the LAN's DHCP server.
+// The addresses are looked up in the host neighbor table and then asked to the guest agent.
+func WatchBridgedIPAddress() {
+	for {
+		time.Sleep(neighborPollInterval)
+
+		vms, err := ListVMs()
+		if err != nil {
+			log.Println("Ignore ListVMs error:", err)
+			continue
+		}
+		neighbors, err := getNeighbors()
+		if err != nil {
+			log.Println("Ignore getNeighbors error:", err)
+		}
+
+		for _, vm := range vms {
+			if vm.Status == "stopped" {
+				continue
+			}
+			var guestIFs []guestInterface
+			for _, nic := range vm.NICs {
+				nw, err := GetNetwork(nic.Network)
+				if err != nil || !isBridgedNetwork(nw) {
+					continue
+				}
+
+				addr := neighbors[nic.MacAddress]
+				if addr.ipv4 == "" {
+					if guestIFs == nil {
+						guestIFs, _ = getGuestInterfaces(vm.Name)
+					}
+					addr = findGuestAddress(guestIFs, nic.MacAddress)
+				}
+				if addr.ipv4 == "" || (addr.ipv4 == nic.IPAddress && addr.ipv6 == nic.IPv6Address) {
+					continue
+				}
+				VMIPAddressUpdateChan <- &VMMetaData{MacAddress: nic.MacAddress, IPAddress: addr.ipv4, IPv6Address: addr.ipv6}
+			}
+		}
+	}
+}
+
+type neighborAddress struct {
+	ipv4 string
+	ipv6 string
+}
+
+// getNeighbors returns the host neighbor table as MAC address to IP addresses map.
+func getNeighbors() (map[string]neighborAddress, error) {
+	out, err := ExecsStdout([][]string{
+		{"ip", "neigh", "show"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseNeighbors(out[0]), nil
+}
+
+// parseNeighbors parses the output of `ip neigh show` (e.g. "192.168.1.10 dev br0 lladdr 52:54:00:12:34:56 REACHABLE").
+func parseNeighbors(out string) map[string]neighborAddress {
+	ret := map[string]neighborAddress{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 5 {
+			continue
+		}
+		state := f[len(f)-1]
+		if state == "FAILED" || state == "INCOMPLETE" {
+			continue
+		}
+		ip := net.ParseIP(f[0])
+		if ip == nil {
+			continue
+		}
+		mac := ""
+		for i := range f[:len(f)-1] {
+			if f[i] == "lladdr" {
+				mac = f[i+1]
+			}
+		}
+		if mac == "" {
+			continue
+		}
+
+		addr := ret[mac]
+		if ip.To4() != nil {
+			addr.ipv4 = ip.String()
+		} else if ip.IsGlobalUnicast() {
+			addr.ipv6 = ip.String()
+		}
+		ret[mac] = addr
+	}
+	return ret
+}
+
+type guestInterface struct {
+	Name            string `json:"name"`
+	HardwareAddress string `json:"hardware-address"`
+	IPAddresses     []struct {
+		Type    string `json:"ip-address-type"`
+		Address string `json:"ip-address"`
+	} `json:"ip-addresses"`
+}
+
+// getGuestInterfaces asks the network interfaces to the qemu guest agent in the VM.
+func getGuestInterfaces(name string) ([]guestInterface, error) {
+	conn, err := net.DialTimeout("unix", getQGASocketPath(name), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// guest-sync discards the stale responses left in the channel
+	syncID := time.Now().UnixNano() & 0x7fffffff
+	fmt.Fprintf(conn, `{"execute":"guest-sync","arguments":{"id":%d}}`+"\n", syncID)
+	fmt.Fprintf(conn, `{"execute":"guest-network-get-interfaces"}`+"\n")
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	synced := false
+	for scanner.Scan() {
+		if !synced {
+			var resp struct {
+				Return int64 `json:"return"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &resp) == nil && resp.Return == syncID {
+				synced = true
+			}
+			continue
+		}
+
+		var resp struct {
+			Return []guestInterface `json:"return"`
+			Error  *struct {
+				Desc string `json:"desc"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			return nil, err
+		}
+		if resp.Error != nil {
+			return nil, errors.New(resp.Error.Desc)
+		}
+		return resp.Return, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no response from guest agent")
+}
+
+func findGuestAddress(ifs []guestInterface, macAddr string) neighborAddress {
+	addr := neighborAddress{}
+	for _, i := range ifs {
+		if i.HardwareAddress != macAddr {
+			continue
+		}
+		for _, a := range i.IPAddresses {
+			ip := net.ParseIP(a.Address)
+			if ip == nil {
+				continue
+			}
+			if a.Type == "ipv4" && addr.ipv4 == "" {
+				addr.ipv4 = ip.String()
+			}
+			if a.Type == "ipv6" && addr.ipv6 == "" && ip.IsGlobalUnicast() {
+				addr.ipv6 = ip.String()
+			}
+		}
+	}
+	return addr
+}
@@ -43,6 +43,9 @@ func ensureDir() error {
 	dirs := []string{
 		filepath.Join(minivmm.C.Dir, "forwards"),
 		filepath.Join(minivmm.C.Dir, "images"),
+		filepath.Join(minivmm.C.Dir, "networks"),
+		filepath.Join(minivmm.C.Dir, "security-groups"),
+		filepath.Join(minivmm.C.Dir, "ssh-keys"),
 		filepath.Join(minivmm.C.Dir, "vms"),
 	}
 	for _, dir := range dirs {
@@ -77,7 +80,15 @@ func server() {
 	handler := c.Handler(mux)
 
 	go minivmm.ServeDHCP()
+	go minivmm.ServeRA()
 	go minivmm.UpdateIPAddress()
+	go minivmm.WatchBridgedIPAddress()
+	go minivmm.WatchIPv6Address()
+	go minivmm.ServeHTTPProxy()
+	go minivmm.ServeTLSPassthrough()
+	go minivmm.WatchForwardExpiration()
+	go minivmm.ServeSSHBastion()
+	go minivmm.WatchConsoleLogs()
 
 	log.Println("Starting minivm..")
 	if minivmm.C.NoTLS {
@@ -90,6 +101,15 @@ func server() {
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// the client mode does not need the server configurations
+	if len(os.Args) > 1 && os.Args[1] == "tunnel" {
+		err := tunnel(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := minivmm.ParseConfig()
 	if err != nil {
 		panic(err)
@@ -111,11 +131,15 @@ func main() {
 		return
 	}
 
+	err = ensureDir()
+	if err != nil {
+		log.Fatal(err)
+	}
 	err = minivmm.StartNetwork()
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = ensureDir()
+	err = minivmm.ApplySecurityGroups()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"minivmm"
+)
+
+// tunnel exposes the TCP port of the VM as a local port through the websocket tunnel of the minivmm API port.
+func tunnel(args []string) error {
+	flags := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	server := flags.String("server", os.Getenv("VMM_ORIGIN"), "minivmm server URL like https://example.com:14151")
+	name := flags.String("name", "", "destination VM name")
+	port := flags.Int("port", 22, "destination port of the VM")
+	listen := flags.String("listen", "127.0.0.1:0", "local listen address")
+	token := flags.String("token", os.Getenv("VMM_TOKEN"), "access token (the value of minivmm_token cookie)")
+	insecure := flags.Bool("insecure", false, "skip verification of the server certificate")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("missing -name option")
+	}
+	config, err := newTunnelConfig(*server, *name, *port, *token, *insecure)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("Listening on %s for %s:%d\n", ln.Addr(), *name, *port)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := relayTunnel(conn, config)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+func newTunnelConfig(server, name string, port int, token string, insecure bool) (*websocket.Config, error) {
+	origin, err := url.Parse(server)
+	if err != nil || origin.Host == "" {
+		return nil, fmt.Errorf("invalid server URL '%s'", server)
+	}
+
+	location := *origin
+	switch origin.Scheme {
+	case "https":
+		location.Scheme = "wss"
+	case "http":
+		location.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("invalid server URL scheme '%s'", origin.Scheme)
+	}
+	location.Path = "/ws/tunnel"
+	location.RawQuery = url.Values{"name": {name}, "port": {fmt.Sprint(port)}}.Encode()
+
+	config, err := websocket.NewConfig(location.String(), origin.Scheme+"://"+origin.Host)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{"binary"}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: insecure}
+	if token != "" {
+		config.Header = http.Header{}
+		config.Header.Add("Cookie", (&http.Cookie{Name: minivmm.CookieName, Value: token}).String())
+	}
+	return config, nil
+}
+
+// withConsoleToken returns a copy of the config with a new console token, which is valid for only one connection.
+func withConsoleToken(config *websocket.Config) (*websocket.Config, error) {
+	query := config.Location.Query()
+	u := *config.Origin
+	u.Path = fmt.Sprintf("/api/v1/vms/%s/console", query.Get("name"))
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range config.Header {
+		req.Header[k] = v
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config.TlsConfig},
+		Timeout:   10 * time.Second,
+		// the API redirects to the auth page if the access token is invalid
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get console token: %s %s", resp.Status, string(b))
+	}
+	token := minivmm.ConsoleToken{}
+	err = json.Unmarshal(b, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	location := *config.Location
+	query.Set("token", token.Token)
+	location.RawQuery = query.Encode()
+	c := *config
+	c.Location = &location
+	return &c, nil
+}
+
+func relayTunnel(conn net.Conn, config *websocket.Config) error {
+	defer conn.Close()
+
+	config, err := withConsoleToken(config)
+	if err != nil {
+		return err
+	}
+	wsconn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer wsconn.Close()
+	wsconn.PayloadType = websocket.BinaryFrame
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(wsconn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, wsconn)
+		done <- struct{}{}
+	}()
+	<-done
+	return nil
+}
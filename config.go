@@ -8,24 +8,41 @@ import (
 
 // Config is the minivmm configuration structure.
 type Config struct {
-	Dir               string   `env:"VMM_DIR" envDefault:"/opt/minivmm"`
-	Port              int      `env:"VMM_LISTEN_PORT" envDefault:"14151"`
-	Origin            string   `env:"VMM_ORIGIN,required"`
-	OIDC              string   `env:"VMM_OIDC_URL"`
-	Agents            []string `env:"VMM_AGENTS" envSeparator:","`
-	CorsOrigins       []string `env:"VMM_CORS_ALLOWED_ORIGINS" envSeparator:","`
-	SubnetCIDR        string   `env:"VMM_SUBNET_CIDR"`
-	NameServers       []string `env:"VMM_NAME_SERVERS" envDefault:"1.1.1.1,1.0.0.1" envSeparator:","`
-	ServerCert        string   `env:"VMM_SERVER_CERT"`
-	ServerKey         string   `env:"VMM_SERVER_KEY"`
-	NoTLS             bool     `env:"VMM_NO_TLS" envDefault:"false"`
-	NoAuth            bool     `env:"VMM_NO_AUTH" envDefault:"false"`
-	NoKvm             bool     `env:"VMM_NO_KVM" envDefault:"false"`
-	VNCKeyboardLayout string   `env:"VMM_VNC_KEYBOARD_LAYOUT" envDefault:"en-us"`
-
-	VMDir      string
-	ImageDir   string
-	ForwardDir string
+	Dir                string   `env:"VMM_DIR" envDefault:"/opt/minivmm"`
+	Port               int      `env:"VMM_LISTEN_PORT" envDefault:"14151"`
+	Origin             string   `env:"VMM_ORIGIN,required"`
+	OIDC               string   `env:"VMM_OIDC_URL"`
+	Agents             []string `env:"VMM_AGENTS" envSeparator:","`
+	CorsOrigins        []string `env:"VMM_CORS_ALLOWED_ORIGINS" envSeparator:","`
+	SubnetCIDR         string   `env:"VMM_SUBNET_CIDR"`
+	SubnetCIDR6        string   `env:"VMM_SUBNET_CIDR6"`
+	NameServers        []string `env:"VMM_NAME_SERVERS" envDefault:"1.1.1.1,1.0.0.1" envSeparator:","`
+	ServerCert         string   `env:"VMM_SERVER_CERT"`
+	ServerKey          string   `env:"VMM_SERVER_KEY"`
+	NoTLS              bool     `env:"VMM_NO_TLS" envDefault:"false"`
+	NoAuth             bool     `env:"VMM_NO_AUTH" envDefault:"false"`
+	NoKvm              bool     `env:"VMM_NO_KVM" envDefault:"false"`
+	VNCKeyboardLayout  string   `env:"VMM_VNC_KEYBOARD_LAYOUT" envDefault:"en-us"`
+	VNCPassword        bool     `env:"VMM_VNC_PASSWORD" envDefault:"false"`
+	UserNetworks       bool     `env:"VMM_USER_NETWORKS" envDefault:"false"`
+	UserNetworkCIDR    string   `env:"VMM_USER_NETWORK_CIDR" envDefault:"10.200.0.0/16"`
+	OverlayVNI         int      `env:"VMM_OVERLAY_VNI" envDefault:"0"`
+	OverlayLocalIP     string   `env:"VMM_OVERLAY_LOCAL_IP"`
+	ForwardBackend     string   `env:"VMM_FORWARD_BACKEND" envDefault:"proxy"`
+	HTTPProxyPort      int      `env:"VMM_HTTP_PROXY_PORT" envDefault:"0"`
+	HTTPSProxyPort     int      `env:"VMM_HTTPS_PROXY_PORT" envDefault:"0"`
+	HTTPProxyDomain    string   `env:"VMM_HTTP_PROXY_DOMAIN"`
+	TLSPassthroughPort int      `env:"VMM_TLS_PASSTHROUGH_PORT" envDefault:"0"`
+	SSHBastionPort     int      `env:"VMM_SSH_BASTION_PORT" envDefault:"0"`
+	SSHHostKey         string   `env:"VMM_SSH_HOST_KEY"`
+
+	VMDir            string
+	ImageDir         string
+	ForwardDir       string
+	NetworkDir       string
+	SecurityGroupDir string
+	CertDir          string
+	SSHKeyDir        string
 }
 
 // C is a global configuration object.
@@ -40,6 +57,13 @@ func ParseConfig() error {
 	c.VMDir = filepath.Join(c.Dir, "vms")
 	c.ImageDir = filepath.Join(c.Dir, "images")
 	c.ForwardDir = filepath.Join(c.Dir, "forwards")
+	c.NetworkDir = filepath.Join(c.Dir, "networks")
+	c.SecurityGroupDir = filepath.Join(c.Dir, "security-groups")
+	c.CertDir = filepath.Join(c.Dir, "certs")
+	c.SSHKeyDir = filepath.Join(c.Dir, "ssh-keys")
+	if c.SSHHostKey == "" {
+		c.SSHHostKey = filepath.Join(c.Dir, "ssh_host_key")
+	}
 
 	C = &c
 	return nil
@@ -0,0 +1,93 @@
+package minivmm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const consoleTokenTTL = 30 * time.Second
+
+// ConsoleToken is a short-lived and single-use token to connect to the console of the VM.
+type ConsoleToken struct {
+	Token       string `json:"token"`
+	ExpiresAt   string `json:"expires_at"`
+	VNCPassword string `json:"vnc_password,omitempty"`
+}
+
+type consoleTokenEntry struct {
+	vmName    string
+	expiresAt time.Time
+}
+
+var (
+	consoleTokensMu sync.Mutex
+	consoleTokens   = map[string]*consoleTokenEntry{}
+)
+
+func generateConsoleToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssueConsoleToken issues a new console token of the specified VM.
+func IssueConsoleToken(name string) (*ConsoleToken, error) {
+	metaData, err := loadVMMetaData(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "IssueConsoleToken: Failed to get VM metadata")
+	}
+
+	token, err := generateConsoleToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "IssueConsoleToken: Failed to generate token")
+	}
+	expiresAt := time.Now().Add(consoleTokenTTL)
+
+	consoleTokensMu.Lock()
+	defer consoleTokensMu.Unlock()
+	// drop expired tokens which have never been used
+	for k, v := range consoleTokens {
+		if time.Now().After(v.expiresAt) {
+			delete(consoleTokens, k)
+		}
+	}
+	consoleTokens[token] = &consoleTokenEntry{vmName: name, expiresAt: expiresAt}
+
+	ret := &ConsoleToken{
+		Token:     token,
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	}
+	if C.VNCPassword {
+		ret.VNCPassword = metaData.VNCPassword
+	}
+	return ret, nil
+}
+
+// ConsumeConsoleToken validates the console token of the specified VM.
+// The token is invalidated whether it's valid or not.
+func ConsumeConsoleToken(token, name string) error {
+	consoleTokensMu.Lock()
+	defer consoleTokensMu.Unlock()
+
+	e, ok := consoleTokens[token]
+	if !ok {
+		return fmt.Errorf("invalid console token")
+	}
+	delete(consoleTokens, token)
+
+	if time.Now().After(e.expiresAt) {
+		return fmt.Errorf("console token has expired")
+	}
+	if e.vmName != name {
+		return fmt.Errorf("console token is not for VM '%s'", name)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package minivmm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsoleToken(t *testing.T) {
+	cleanup := prepareTestConsoleLog(t, "", "")
+	defer cleanup()
+
+	token, err := IssueConsoleToken("vm1")
+	if err != nil {
+		t.Fatalf("failed to issue console token: %v", err)
+	}
+	if err := ConsumeConsoleToken(token.Token, "vm2"); err == nil {
+		t.Errorf("token is accepted for another VM")
+	}
+	// the token is invalidated by the failed attempt
+	if err := ConsumeConsoleToken(token.Token, "vm1"); err == nil {
+		t.Errorf("token is accepted after it's used")
+	}
+
+	token, _ = IssueConsoleToken("vm1")
+	if err := ConsumeConsoleToken(token.Token, "vm1"); err != nil {
+		t.Errorf("failed to consume console token: %v", err)
+	}
+	if err := ConsumeConsoleToken(token.Token, "vm1"); err == nil {
+		t.Errorf("token is accepted twice")
+	}
+
+	token, _ = IssueConsoleToken("vm1")
+	consoleTokens[token.Token].expiresAt = time.Now().Add(-time.Second)
+	if err := ConsumeConsoleToken(token.Token, "vm1"); err == nil {
+		t.Errorf("expired token is accepted")
+	}
+
+	if _, err := IssueConsoleToken("vm2"); err == nil {
+		t.Errorf("token is issued for nonexistent VM")
+	}
+}
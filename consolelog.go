@@ -0,0 +1,191 @@
+package minivmm
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	consoleLogFileName        = "console.log"
+	consoleLogMaxSize         = 1024 * 1024
+	consoleLogRotateInterval  = 30 * time.Second
+	consoleLogRotatedFileName = consoleLogFileName + ".1"
+	// the generation is incremented when the log is rotated, since the offset is meaningless across rotations
+	consoleLogGenerationFileName = consoleLogFileName + ".gen"
+)
+
+// ConsoleLog is a part of the serial console output of the VM.
+// Offset and Generation are the cursor of the current log file,
+// which can be passed as `since` and `generation` to read the following output.
+type ConsoleLog struct {
+	Log        string `json:"console_log"`
+	Offset     int64  `json:"offset"`
+	Generation int64  `json:"generation"`
+}
+
+func getConsoleLogPath(name string) string {
+	return filepath.Join(C.VMDir, name, consoleLogFileName)
+}
+
+func getRotatedConsoleLogPath(name string) string {
+	return filepath.Join(C.VMDir, name, consoleLogRotatedFileName)
+}
+
+func getConsoleLogGeneration(name string) (int64, error) {
+	b, err := readFileIfExists(filepath.Join(C.VMDir, name, consoleLogGenerationFileName))
+	if err != nil || len(b) == 0 {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func setConsoleLogGeneration(name string, gen int64) error {
+	path := filepath.Join(C.VMDir, name, consoleLogGenerationFileName)
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(gen, 10)), 0644)
+}
+
+// rotateConsoleLog moves the log to the rotated file if it's larger than maxSize.
+// The log file is copied and truncated since qemu keeps it opened in append mode.
+func rotateConsoleLog(name string, maxSize int64) error {
+	path := getConsoleLogPath(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() <= maxSize {
+		return nil
+	}
+
+	src, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(getRotatedConsoleLogPath(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return errors.Wrap(err, "rotateConsoleLog: failed to copy console log")
+	}
+	gen, err := getConsoleLogGeneration(name)
+	if err != nil {
+		return err
+	}
+	err = setConsoleLogGeneration(name, gen+1)
+	if err != nil {
+		return err
+	}
+	return src.Truncate(0)
+}
+
+// WatchConsoleLogs rotates the console logs of VMs periodically.
+func WatchConsoleLogs() {
+	for {
+		time.Sleep(consoleLogRotateInterval)
+
+		vms, err := ListVMs()
+		if err != nil {
+			log.Println("Ignore ListVMs error:", err)
+			continue
+		}
+		for _, vm := range vms {
+			err := rotateConsoleLog(vm.Name, consoleLogMaxSize)
+			if err != nil {
+				log.Println("Ignore rotateConsoleLog error:", err)
+			}
+		}
+	}
+}
+
+func readFileIfExists(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// tailLines returns the last n lines of b.
+func tailLines(b []byte, n int) []byte {
+	// ignore the trailing newline not to count an empty line
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if b[i] == '\n' {
+			n--
+			if n == 0 {
+				return b[i+1:]
+			}
+		}
+	}
+	return b
+}
+
+// GetConsoleLog returns the serial console output of the VM.
+// If since is not negative, the output after the cursor (since and generation) is returned.
+// If the log is rotated once after the cursor, the rest of the rotated log is also returned.
+// If it's rotated more, or the offset exceeds the log size, the whole logs are returned since the cursor is lost.
+// The current generation is used if generation is negative.
+// If tail is positive, only the last lines are returned.
+func GetConsoleLog(name string, since, generation int64, tail int) (*ConsoleLog, error) {
+	if _, err := loadVMMetaData(name); err != nil {
+		return nil, errors.Wrap(err, "GetConsoleLog: Failed to get VM metadata")
+	}
+
+	gen, err := getConsoleLogGeneration(name)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readFileIfExists(getConsoleLogPath(name))
+	if err != nil {
+		return nil, err
+	}
+	ret := &ConsoleLog{Offset: int64(len(current)), Generation: gen}
+	if generation < 0 {
+		generation = gen
+	}
+
+	var b []byte
+	switch {
+	case since >= 0 && generation == gen && since <= int64(len(current)):
+		b = current[since:]
+	case since >= 0 && generation == gen-1:
+		rotated, err := readFileIfExists(getRotatedConsoleLogPath(name))
+		if err != nil {
+			return nil, err
+		}
+		if since <= int64(len(rotated)) {
+			rotated = rotated[since:]
+		}
+		b = append(rotated, current...)
+	default:
+		rotated, err := readFileIfExists(getRotatedConsoleLogPath(name))
+		if err != nil {
+			return nil, err
+		}
+		b = append(rotated, current...)
+	}
+
+	if tail > 0 {
+		b = tailLines(b, tail)
+	}
+	ret.Log = string(b)
+	return ret, nil
+}
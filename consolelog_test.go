@@ -0,0 +1,126 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func prepareTestConsoleLog(t *testing.T, rotated, current string) func() {
+	dir, err := ioutil.TempDir("", "minivmm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	SetConfig(&Config{VMDir: dir})
+
+	vmDir := filepath.Join(dir, "vm1")
+	os.MkdirAll(vmDir, 0755)
+	b, _ := json.Marshal(&VMMetaData{Name: "vm1"})
+	ioutil.WriteFile(filepath.Join(vmDir, vmMetaDataFileName), b, 0644)
+	if rotated != "" {
+		ioutil.WriteFile(getRotatedConsoleLogPath("vm1"), []byte(rotated), 0644)
+	}
+	ioutil.WriteFile(getConsoleLogPath("vm1"), []byte(current), 0644)
+
+	return func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetConsoleLog(t *testing.T) {
+	cleanup := prepareTestConsoleLog(t, "a\nb\n", "c\nd\ne\n")
+	defer cleanup()
+
+	cases := []struct {
+		since    int64
+		tail     int
+		expected string
+	}{
+		{-1, 0, "a\nb\nc\nd\ne\n"},
+		{-1, 2, "d\ne\n"},
+		{-1, 4, "b\nc\nd\ne\n"},
+		{-1, 10, "a\nb\nc\nd\ne\n"},
+		{2, 0, "d\ne\n"},
+		{2, 1, "e\n"},
+		{6, 0, ""},
+		// the cursor is lost
+		{100, 0, "a\nb\nc\nd\ne\n"},
+	}
+	for _, c := range cases {
+		l, err := GetConsoleLog("vm1", c.since, -1, c.tail)
+		if err != nil {
+			t.Fatalf("failed to get console log: %v", err)
+		}
+		if l.Log != c.expected {
+			t.Errorf("unexpected log of since:%d tail:%d; expected:%q actual:%q", c.since, c.tail, c.expected, l.Log)
+		}
+		if l.Offset != 6 {
+			t.Errorf("unexpected offset; expected:6 actual:%d", l.Offset)
+		}
+	}
+}
+
+func TestRotateConsoleLog(t *testing.T) {
+	cleanup := prepareTestConsoleLog(t, "old\n", "0123456789\n")
+	defer cleanup()
+
+	if err := rotateConsoleLog("vm1", 100); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(getRotatedConsoleLogPath("vm1")); string(b) != "old\n" {
+		t.Errorf("log is rotated before it exceeds the max size")
+	}
+
+	if err := rotateConsoleLog("vm1", 5); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(getRotatedConsoleLogPath("vm1")); string(b) != "0123456789\n" {
+		t.Errorf("unexpected rotated log: %q", string(b))
+	}
+	if b, _ := ioutil.ReadFile(getConsoleLogPath("vm1")); len(b) != 0 {
+		t.Errorf("log is not truncated: %q", string(b))
+	}
+}
+
+func TestGetConsoleLogAcrossRotation(t *testing.T) {
+	cleanup := prepareTestConsoleLog(t, "", "a\nb\n")
+	defer cleanup()
+
+	l, err := GetConsoleLog("vm1", -1, -1, 0)
+	if err != nil {
+		t.Fatalf("failed to get console log: %v", err)
+	}
+	if l.Offset != 4 || l.Generation != 0 {
+		t.Fatalf("unexpected cursor; offset:%d generation:%d", l.Offset, l.Generation)
+	}
+
+	appendLog := func(s string) {
+		f, _ := os.OpenFile(getConsoleLogPath("vm1"), os.O_WRONLY|os.O_APPEND, 0644)
+		f.WriteString(s)
+		f.Close()
+	}
+	// the log grows past the previous offset after the rotation
+	appendLog("c\n")
+	if err := rotateConsoleLog("vm1", 0); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	appendLog("d\ne\nf\n")
+
+	next, err := GetConsoleLog("vm1", l.Offset, l.Generation, 0)
+	if err != nil {
+		t.Fatalf("failed to get console log: %v", err)
+	}
+	if next.Log != "c\nd\ne\nf\n" {
+		t.Errorf("unexpected log after rotation: %q", next.Log)
+	}
+	if next.Offset != 6 || next.Generation != 1 {
+		t.Errorf("unexpected cursor; offset:%d generation:%d", next.Offset, next.Generation)
+	}
+
+	next, _ = GetConsoleLog("vm1", next.Offset, next.Generation, 0)
+	if next.Log != "" {
+		t.Errorf("unexpected log: %q", next.Log)
+	}
+}
@@ -1,6 +1,7 @@
 package minivmm
 
 import (
+	"encoding/binary"
 	"log"
 	"math/rand"
 	"net"
@@ -11,47 +12,88 @@ import (
 	"github.com/krolaw/dhcp4/conn"
 )
 
-func parseNameServers() []byte {
+// parseNameServers splits the name servers into IPv4 ones for DHCP and IPv6 ones for router advertisements.
+func parseNameServers() ([]byte, []net.IP) {
 	servers := C.NameServers
 	addresses := []byte{}
+	addresses6 := []net.IP{}
 	for _, serverIP := range servers {
 		ip := net.ParseIP(serverIP)
-		ip = ip.To4()
 		if ip == nil {
-			panic("could not parse the string as IPv4: " + serverIP)
+			log.Println("[dhcp] WARN could not parse the string as IP address, ignore it:", serverIP)
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			addresses = append(addresses, ip4...)
+		} else {
+			addresses6 = append(addresses6, ip)
 		}
-		addresses = append(addresses, ip...)
 	}
-	return addresses
+	return addresses, addresses6
 }
 
-// ServeDHCP serves DHCP.
+// ServeDHCP serves DHCP for all networks.
+// The additional networks are served in the background, and the default network is served in the foreground.
 func ServeDHCP() {
-	nwInfo, err := newNetworkInfo()
+	nws, err := ListNetworks()
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, nw := range nws {
+		if nw.Name != DefaultNetworkName {
+			startNetworkServers(nw)
+		}
+	}
 
-	dnsIPs := parseNameServers()
+	log.Fatal(serveDHCP(getDefaultNetwork(), nil))
+}
+
+func serveDHCP(nw *NetworkMetaData, stopChan chan struct{}) error {
+	nwInfo, err := newNetworkInfo(nw)
+	if err != nil {
+		return err
+	}
+
+	dnsIPs, _ := parseNameServers()
+	options := dhcp.Options{
+		dhcp.OptionSubnetMask:       []byte(nwInfo.cidrIPNet.Mask),
+		dhcp.OptionDomainNameServer: dnsIPs,
+	}
+	if !nw.Isolated {
+		options[dhcp.OptionRouter] = []byte(nwInfo.gwIP)
+	}
+	startIP, leaseRange := nwInfo.startIP, nwInfo.leaseRange
+	if overlayEnabled() && nw.Name == DefaultNetworkName {
+		startIP, leaseRange, err = getOverlayLeaseRange(startIP, leaseRange)
+		if err != nil {
+			return err
+		}
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, overlayMTU)
+		options[dhcp.OptionInterfaceMTU] = mtu
+	}
 	handler := &dhcpHandler{
 		ip:            nwInfo.gwIP,
-		start:         nwInfo.startIP,
-		leaseRange:    (1 << uint(32-nwInfo.cidrLen)) - 4,
+		start:         startIP,
+		leaseRange:    leaseRange,
 		leaseDuration: 2 * time.Hour,
 		leases:        make(map[int]lease, 32),
-		macVendor:     "52:54:00",
-		options: dhcp.Options{
-			dhcp.OptionSubnetMask:       []byte(nwInfo.cidrIPNet.Mask),
-			dhcp.OptionRouter:           []byte(nwInfo.gwIP),
-			dhcp.OptionDomainNameServer: dnsIPs,
-		},
+		macVendor:     vmMACVendor,
+		options:       options,
 	}
 
-	pc, err := conn.NewUDP4BoundListener(vethNames[0], ":67")
+	_, veths := getNetworkIFNames(nw)
+	pc, err := conn.NewUDP4BoundListener(veths[0], ":67")
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if stopChan != nil {
+		go func() {
+			<-stopChan
+			pc.Close()
+		}()
 	}
-	log.Fatal(dhcp.Serve(pc, handler))
+	return dhcp.Serve(pc, handler)
 }
 
 type lease struct {
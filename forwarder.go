@@ -1,6 +1,7 @@
 package minivmm
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,234 +10,541 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-var (
-	stopChannels = make(map[string]chan struct{})
+const (
+	forwardResolveTimeout     = 60 * time.Second
+	forwardExpirationInterval = 10 * time.Second
+)
 
-	nameToIP   = map[string]string{}
-	ipChannels = make(map[string]map[string]chan struct{})
+const (
+	// ForwardBackendProxy copies the forwarded traffic in minivmm.
+	ForwardBackendProxy = "proxy"
+	// ForwardBackendDNAT forwards the traffic by DNAT rules in kernel. The VM sees the client source address.
+	// The rules are applied only to the traffic from outside, so connections from the host itself (loopback)
+	// and from VMs to the host address (hairpin) are not forwarded.
+	ForwardBackendDNAT = "dnat"
 )
 
-func proxyUDPStream(fromPort, toIP, toPort string) (*net.UDPConn, *net.UDPConn, error) {
-	laddr, err := net.ResolveUDPAddr("udp", ":"+fromPort)
-	if err != nil {
-		log.Println("[forwarder] WARN ResolveUDPAddr error: ", err.Error())
-		return nil, nil, err
+// Forwarder manages the running forwards and the addresses of the VMs they forward to.
+type Forwarder struct {
+	resolveTimeout time.Duration
+	// applyRules is called when the DNAT rules are changed.
+	applyRules func() error
+
+	mu       sync.Mutex
+	forwards map[string]*runningForward
+	addrs    map[string]string
+	// addrUpdated is closed and replaced when any address is updated, to wake up the waiters for resolution.
+	addrUpdated chan struct{}
+}
+
+type runningForward struct {
+	fw *ForwardMetaData
+	// ctx is cancelled when the forwarding is stopped to abort its listener, sessions and requests.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// addrChanged is notified when the address of the destination VM is changed.
+	addrChanged chan struct{}
+	dnat        bool
+	http        bool
+	tls         bool
+	// limiter is nil if the forwarding has no limits.
+	limiter *forwardLimiter
+	// stats is the connections and traffic of the forwarding. It's nil for dnat, which is handled by the kernel.
+	stats *forwardStats
+	// health is nil if the health check is disabled.
+	health *forwardHealth
+}
+
+// NewForwarder returns an empty forwarder.
+func NewForwarder() *Forwarder {
+	return &Forwarder{
+		resolveTimeout: forwardResolveTimeout,
+		forwards:       map[string]*runningForward{},
+		addrs:          map[string]string{},
+		addrUpdated:    make(chan struct{}),
 	}
+}
 
-	src, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Println("[forwarder] WARN ListenUDP error: ", err.Error())
-		return nil, nil, err
+var defaultForwarder = NewForwarder()
+
+func init() {
+	defaultForwarder.applyRules = applyHostRules
+}
+
+func getForwardBackend(fw *ForwardMetaData) string {
+	if fw.Backend != "" {
+		return fw.Backend
+	}
+	if C != nil && C.ForwardBackend != "" {
+		return C.ForwardBackend
+	}
+	return ForwardBackendProxy
+}
+
+// forwardNetwork returns the network name to listen on. The empty family listens on both IPv4 and IPv6.
+func forwardNetwork(proto, family string) (string, error) {
+	switch family {
+	case "":
+		return proto, nil
+	case "ipv4":
+		return proto + "4", nil
+	case "ipv6":
+		return proto + "6", nil
+	}
+	return "", fmt.Errorf("unknown address family: %s", family)
+}
+
+// Start binds the listen port and starts forwarding in the background.
+func (f *Forwarder) Start(fw *ForwardMetaData) error {
+	if err := validateProxyProtocol(fw); err != nil {
+		return err
+	}
+	if err := validateForwardLimits(fw); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(fw); err != nil {
+		return err
 	}
 
-	raddr, err := net.ResolveUDPAddr("udp", toIP+":"+toPort)
+	err := f.start(fw)
 	if err != nil {
-		log.Println("[forwarder] WARN ResolveUDPAddr error: ", err.Error())
-		return nil, nil, err
+		return err
+	}
+	if fw.HealthCheck != nil {
+		f.startHealthCheck(generateForwardID(fw.Proto, fw.FromPort))
+	}
+	return nil
+}
+
+func (f *Forwarder) start(fw *ForwardMetaData) error {
+	if fw.Type == ForwardTypeHTTP {
+		fw.Proto = forwardProtoHTTP
+		return f.startHTTP(generateForwardID(fw.Proto, fw.FromPort), fw)
+	}
+	if fw.Type == ForwardTypeTLS {
+		fw.Proto = forwardProtoTLS
+		return f.startTLS(generateForwardID(fw.Proto, fw.FromPort), fw)
 	}
 
-	dst, err := net.DialUDP("udp", nil, raddr)
+	proto := fw.Proto
+	if proto != "udp" {
+		proto = "tcp"
+	}
+	network, err := forwardNetwork(proto, fw.Family)
 	if err != nil {
-		log.Println("[forwarder] WARN DialUDP error: ", err.Error())
-		return nil, nil, err
+		return err
 	}
+	id := generateForwardID(fw.Proto, fw.FromPort)
 
-	go io.Copy(dst, src)
-	go io.Copy(src, dst)
+	switch backend := getForwardBackend(fw); backend {
+	case ForwardBackendProxy:
+	case ForwardBackendDNAT:
+		if fw.Family == "ipv6" {
+			return errors.New("dnat forwarding supports only ipv4")
+		}
+		return f.startDNAT(id, fw)
+	default:
+		return fmt.Errorf("unknown forward backend: %s", backend)
+	}
 
-	return src, dst, nil
-}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-func proxyUDP(stopChan chan struct{}, id, fromPort, toName, toPort string) {
-	ipChan := makeIPChannel(toName, id)
-	defer deleteIPChannel(toName, id)
+	if _, ok := f.forwards[id]; ok {
+		return fmt.Errorf("forwarding already exists: %s", id)
+	}
 
-	for {
-		toIP, err := resolveName(toName)
+	limiter, err := newForwardLimiter(fw)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningForward{
+		fw:          fw,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		addrChanged: make(chan struct{}, 1),
+		limiter:     limiter,
+		stats:       &forwardStats{},
+	}
+
+	listenAddr := net.JoinHostPort(fw.BindAddress, fw.FromPort)
+	if proto == "udp" {
+		laddr, err := net.ResolveUDPAddr(network, listenAddr)
 		if err != nil {
-			log.Printf("[forwarder] WARN could not get IP address for %s\n", toName)
-			return
+			cancel()
+			return err
 		}
-
-		src, dst, err := proxyUDPStream(fromPort, toIP, toPort)
+		ln, err := net.ListenUDP(network, laddr)
 		if err != nil {
-			return
+			cancel()
+			return errors.Wrap(err, "failed to bind to udp port")
 		}
-		defer src.Close()
-		defer dst.Close()
+		go func() {
+			defer close(r.done)
+			f.proxyUDP(r.ctx, r, ln)
+		}()
+	} else {
+		ln, err := net.Listen(network, listenAddr)
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "failed to bind to tcp port")
+		}
+		go func() {
+			defer close(r.done)
+			f.proxyTCP(r.ctx, r, ln)
+		}()
+	}
 
-		// Wait for address updating or stopping
-		select {
-		case <-ipChan:
-			src.Close()
-			dst.Close()
-			log.Println("[forwarder] INFO update udp forwarder dest address, reopen")
-			continue
-		case <-stopChan:
-			log.Println("[forwarder] INFO shutdown udp proxy")
-			return
+	f.forwards[id] = r
+	return nil
+}
+
+// probeDNATPort checks the port is not used by any other process,
+// since the DNAT rule would silently take over the traffic to it.
+func probeDNATPort(fw *ForwardMetaData) error {
+	listenAddr := net.JoinHostPort(fw.BindAddress, fw.FromPort)
+	if fw.Proto == "udp" {
+		laddr, err := net.ResolveUDPAddr("udp4", listenAddr)
+		if err != nil {
+			return err
+		}
+		ln, err := net.ListenUDP("udp4", laddr)
+		if err != nil {
+			return errors.Wrap(err, "udp port is already in use")
 		}
+		return ln.Close()
+	}
+	ln, err := net.Listen("tcp4", listenAddr)
+	if err != nil {
+		return errors.Wrap(err, "tcp port is already in use")
 	}
+	return ln.Close()
 }
 
-func isUDPBindable(port string) error {
-	laddr, err := net.ResolveUDPAddr("udp", ":"+port)
+func (f *Forwarder) startDNAT(id string, fw *ForwardMetaData) error {
+	err := probeDNATPort(fw)
 	if err != nil {
 		return err
 	}
-	c, err := net.ListenUDP("udp", laddr)
+
+	f.mu.Lock()
+	if _, ok := f.forwards[id]; ok {
+		f.mu.Unlock()
+		return fmt.Errorf("forwarding already exists: %s", id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningForward{
+		fw:          fw,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		addrChanged: make(chan struct{}, 1),
+		dnat:        true,
+	}
+	close(r.done)
+	f.forwards[id] = r
+	f.mu.Unlock()
+
+	err = f.updateRules()
 	if err != nil {
-		return err
+		f.mu.Lock()
+		delete(f.forwards, id)
+		f.mu.Unlock()
+		cancel()
+		return errors.Wrap(err, "failed to apply dnat rules")
 	}
-	defer c.Close()
 	return nil
 }
 
-func proxyTCPSession(src net.Conn, toIP, toPort string) {
-	dst, err := net.Dial("tcp", toIP+":"+toPort)
-	if err != nil {
-		log.Println("[forwarder] WARN dial error: ", err.Error())
-		return
+func (f *Forwarder) updateRules() error {
+	if f.applyRules == nil {
+		return nil
 	}
+	return f.applyRules()
+}
 
-	done := make(chan struct{})
+// dnatRules returns the DNAT rules of the forwardings whose destination address is known.
+func (f *Forwarder) dnatRules() []dnatRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	go func() {
-		defer src.Close()
-		defer dst.Close()
-		io.Copy(dst, src)
-		done <- struct{}{}
-	}()
+	rules := []dnatRule{}
+	for _, r := range f.forwards {
+		if !r.dnat {
+			continue
+		}
+		ip, ok := f.addrs[r.fw.ToName]
+		if !ok || ip == "" {
+			continue
+		}
+		proto := r.fw.Proto
+		if proto != "udp" {
+			proto = "tcp"
+		}
+		rules = append(rules, dnatRule{proto: proto, fromPort: r.fw.FromPort, toIP: ip, toPort: r.fw.ToPort,
+			srcCIDRs: r.fw.AllowedCIDRs, bindIP: r.fw.BindAddress})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].proto+rules[i].fromPort < rules[j].proto+rules[j].fromPort
+	})
+	return rules
+}
 
-	go func() {
-		defer src.Close()
-		defer dst.Close()
-		io.Copy(src, dst)
-		done <- struct{}{}
-	}()
+// Stop stops the forwarding and waits for the listener to be closed.
+func (f *Forwarder) Stop(proto, fromPort string) error {
+	id := generateForwardID(proto, fromPort)
+
+	f.mu.Lock()
+	r, ok := f.forwards[id]
+	if ok {
+		delete(f.forwards, id)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown forwarding: %s", id)
+	}
+	r.cancel()
+	<-r.done
+	if r.dnat {
+		return f.updateRules()
+	}
+	return nil
+}
+
+// StopAll stops all forwardings.
+func (f *Forwarder) StopAll() {
+	f.mu.Lock()
+	running := []*runningForward{}
+	for id, r := range f.forwards {
+		running = append(running, r)
+		delete(f.forwards, id)
+	}
+	f.mu.Unlock()
+
+	dnat := false
+	for _, r := range running {
+		r.cancel()
+		<-r.done
+		dnat = dnat || r.dnat
+	}
+	if dnat {
+		if err := f.updateRules(); err != nil {
+			log.Println("Ignore updateRules error:", err)
+		}
+	}
+}
+
+// UpdateAddress updates the IP address of the VM and notifies the forwardings to it.
+// It never blocks even if the forwardings are busy.
+func (f *Forwarder) UpdateAddress(name, ip string) {
+	if f.updateAddress(name, ip) {
+		if err := f.updateRules(); err != nil {
+			log.Println("Ignore updateRules error:", err)
+		}
+	}
+}
+
+// updateAddress updates the address and returns true if DNAT rules need to be updated.
+func (f *Forwarder) updateAddress(name, ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if old, ok := f.addrs[name]; ok && old == ip {
+		return false
+	}
+	f.addrs[name] = ip
+	close(f.addrUpdated)
+	f.addrUpdated = make(chan struct{})
+
+	dnat := false
+	for _, r := range f.forwards {
+		if r.fw.ToName != name {
+			continue
+		}
+		if r.dnat {
+			dnat = true
+			continue
+		}
+		select {
+		case r.addrChanged <- struct{}{}:
+		default:
+			// already notified
+		}
+	}
+	return dnat
+}
+
+// resolve returns the IP address of the VM. It waits for the address to be known until timed out or cancelled.
+func (f *Forwarder) resolve(ctx context.Context, name string) (string, error) {
+	timer := time.NewTimer(f.resolveTimeout)
+	defer timer.Stop()
+
+	for {
+		f.mu.Lock()
+		ip, ok := f.addrs[name]
+		updated := f.addrUpdated
+		f.mu.Unlock()
+		if ok && ip != "" {
+			return ip, nil
+		}
 
-	<-done
-	<-done
+		log.Printf("[forwarder] INFO waiting for resolution for %s..\n", name)
+		select {
+		case <-updated:
+		case <-timer.C:
+			return "", errors.New("waiting for the address resolution is timed out")
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
 }
 
-func proxyTCP(stopChan chan struct{}, fromPort, toName, toPort string) {
-	ln, err := net.Listen("tcp", ":"+fromPort)
+func (f *Forwarder) proxyUDP(ctx context.Context, r *runningForward, ln *net.UDPConn) {
+	toName, toPort := r.fw.ToName, r.fw.ToPort
+
+	toIP, err := f.resolve(ctx, toName)
 	if err != nil {
-		log.Println("[forwarder] WARN listen error: ", err.Error())
+		log.Printf("[forwarder] WARN could not get IP address for %s\n", toName)
+		ln.Close()
 		return
 	}
-	defer ln.Close()
 
-	for {
-		// Accept in the background
-		var conn net.Conn
-		acc := make(chan struct{})
-		go func() {
-			for {
-				conn, err = ln.Accept()
-				if err != nil {
-					if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-						log.Println("[forwarder] WARN listen temporary error: ", err.Error())
-						continue
-					} else {
-						log.Println("[forwarder] INFO shutdown listen")
-						return
-					}
-				}
-				acc <- struct{}{}
-				return
-			}
-		}()
+	p := newUDPProxy(ln, net.JoinHostPort(toIP, toPort), udpSessionIdleTimeout)
+	p.limiter = r.limiter
+	p.stats = r.stats
+	defer p.close()
+	go p.serve()
 
-		// Wait for accepting or stopping
+	for {
+		// Wait for address updating or stopping
 		select {
-		case <-acc:
-			toIP, err := resolveName(toName)
+		case <-r.addrChanged:
+			toIP, err := f.resolve(ctx, toName)
 			if err != nil {
 				log.Printf("[forwarder] WARN could not get IP address for %s\n", toName)
 				continue
 			}
-			go proxyTCPSession(conn, toIP, toPort)
-		case <-stopChan:
+			log.Println("[forwarder] INFO update udp forwarder dest address")
+			p.setUpstream(net.JoinHostPort(toIP, toPort))
+		case <-ctx.Done():
+			log.Println("[forwarder] INFO shutdown udp proxy")
+			return
+		}
+	}
+}
+
+func (f *Forwarder) proxyTCP(ctx context.Context, r *runningForward, ln net.Listener) {
+	// closing the listener unblocks Accept
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Println("[forwarder] WARN listen temporary error: ", err.Error())
+				continue
+			}
 			log.Println("[forwarder] INFO shutdown tcp proxy")
 			return
 		}
+		if err := r.limiter.acquire(conn.RemoteAddr()); err != nil {
+			log.Printf("[forwarder] WARN reject connection from %s: %s\n", conn.RemoteAddr(), err.Error())
+			r.stats.addError()
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.limiter.release()
+			f.proxyTCPSession(ctx, conn, r)
+		}()
 	}
 }
 
-func isTCPBindable(port string) error {
-	ln, err := net.Listen("tcp", ":"+port)
+func (f *Forwarder) proxyTCPSession(ctx context.Context, src net.Conn, r *runningForward) {
+	defer src.Close()
+
+	r.stats.open()
+	defer r.stats.close()
+
+	fw := r.fw
+	toName, toPort := fw.ToName, fw.ToPort
+	toIP, err := f.resolve(ctx, toName)
 	if err != nil {
-		return err
+		log.Printf("[forwarder] WARN could not get IP address for %s\n", toName)
+		r.stats.addError()
+		return
 	}
-	defer ln.Close()
-	return nil
-}
 
-func resolveName(name string) (string, error) {
-	for i := 0; i < 10; i++ {
-		ip, ok := nameToIP[name]
-		if ok {
-			return ip, nil
-		}
-		time.Sleep(6 * time.Second)
-		log.Printf("[forwarder] INFO waiting for resolution for %s..\n", name)
+	var d net.Dialer
+	dst, err := d.DialContext(ctx, "tcp", net.JoinHostPort(toIP, toPort))
+	if err != nil {
+		log.Println("[forwarder] WARN dial error: ", err.Error())
+		r.stats.addError()
+		return
 	}
-	return "", errors.New("waiting for the address resolution is timed out")
-}
+	defer dst.Close()
 
-func makeIPChannel(name, id string) chan struct{} {
-	_, ok := ipChannels[name]
-	if !ok {
-		ipChannels[name] = map[string]chan struct{}{}
+	if fw.ProxyProtocol != "" {
+		err := writeProxyProtocolHeader(dst, fw.ProxyProtocol, src.RemoteAddr(), src.LocalAddr())
+		if err != nil {
+			log.Println("[forwarder] WARN failed to write proxy protocol header: ", err.Error())
+			r.stats.addError()
+			return
+		}
 	}
 
-	c := make(chan struct{})
-	ipChannels[name][id] = c
-	return c
-}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(&countingWriter{dst, r.stats.addIn}, src)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(&countingWriter{src, r.stats.addOut}, dst)
+		done <- struct{}{}
+	}()
 
-func deleteIPChannel(name, id string) {
-	delete(ipChannels[name], id)
+	// the session ends when either side is closed or the forwarding is stopped
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
 }
 
 // StartForward starts new forwarding.
-func StartForward(proto, fromPort, toName, toPort string) error {
-	id := generateForwardID(proto, fromPort)
-
-	ch := make(chan struct{})
-	if proto == "udp" {
-		if err := isUDPBindable(fromPort); err != nil {
-			return errors.Wrap(err, "failed to bind to udp port")
-		}
-		go proxyUDP(ch, id, fromPort, toName, toPort)
-	} else {
-		if err := isTCPBindable(fromPort); err != nil {
-			return errors.Wrap(err, "failed to bind to tcp port")
-		}
-		go proxyTCP(ch, fromPort, toName, toPort)
+func StartForward(fw *ForwardMetaData) error {
+	err := validateForwardHostOwner(fw)
+	if err != nil {
+		return err
 	}
-	stopChannels[id] = ch
-	return nil
+	return defaultForwarder.Start(fw)
 }
 
 // StopForward stop forwarding.
 func StopForward(proto, fromPort string) error {
-	id := generateForwardID(proto, fromPort)
-
-	c, ok := stopChannels[id]
-	if !ok {
-		return fmt.Errorf("unknown forwarding: %s", id)
-	}
-	c <- struct{}{}
-	return nil
+	return defaultForwarder.Stop(proto, fromPort)
 }
 
 // ForwardMetaData is forwarding settings.
@@ -249,6 +557,22 @@ type ForwardMetaData struct {
 	ToPort      string `json:"to_port"`
 	Type        string `json:"type"`
 	Description string `json:"description"`
+	Family      string `json:"family"`
+	Backend     string `json:"backend"`
+	// ProxyProtocol is the PROXY protocol version ("v1" or "v2") prepended to the upstream connection.
+	ProxyProtocol string `json:"proxy_protocol"`
+	// AllowedCIDRs restricts the client addresses. All addresses are allowed if it's empty.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	// MaxConnections is the max number of concurrent connections (UDP sessions), unlimited if 0.
+	MaxConnections int `json:"max_connections"`
+	// RateLimit is the max number of new connections per minute from each client address, unlimited if 0.
+	RateLimit int `json:"rate_limit"`
+	// BindAddress is the local address to listen on. All addresses are used if it's empty.
+	BindAddress string `json:"bind_address"`
+	// ExpiresAt is the time in RFC3339 when the forwarding is removed. It never expires if it's empty.
+	ExpiresAt string `json:"expires_at"`
+	// HealthCheck is the active health check of the destination. It's disabled if nil.
+	HealthCheck *ForwardHealthCheck `json:"health_check"`
 }
 
 func generateForwardID(proto, fromPort string) string {
@@ -262,8 +586,10 @@ func ResumeForwards() error {
 	if err != nil {
 		return err
 	}
+	exists := map[string]bool{}
 	for _, vm := range vms {
 		UpdateIPAddressInForwarder(vm.Name, vm.IPAddress)
+		exists[vm.Name] = true
 	}
 
 	// resume forwards
@@ -272,7 +598,14 @@ func ResumeForwards() error {
 		return err
 	}
 	for _, f := range fws {
-		err := StartForward(f.Proto, f.FromPort, f.ToName, f.ToPort)
+		if !exists[f.ToName] || isForwardExpired(f, time.Now()) {
+			log.Printf("[forwarder] INFO remove orphaned or expired forwarding %s\n", generateForwardID(f.Proto, f.FromPort))
+			if err := RemoveForwardFile(f); err != nil {
+				log.Println("Ignore RemoveForwardFile error:", err)
+			}
+			continue
+		}
+		err := StartForward(f)
 		if err != nil {
 			return err
 		}
@@ -281,19 +614,105 @@ func ResumeForwards() error {
 	return nil
 }
 
-// UpdateIPAddressInForwarder updates the IP address associated to VM.
-func UpdateIPAddressInForwarder(name, ip string) {
-	nameToIP[name] = ip
+// UpdateForward applies the changes of the forwarding. It's restarted if the destination or health check is changed.
+func UpdateForward(old, fw *ForwardMetaData) error {
+	if generateForwardID(old.Proto, old.FromPort) != generateForwardID(fw.Proto, fw.FromPort) {
+		return errors.New("UpdateForward: protocol and listen port can not be changed")
+	}
 
-	channels, ok := ipChannels[name]
-	if !ok {
-		return
+	if old.ToName != fw.ToName || old.ToPort != fw.ToPort || !reflect.DeepEqual(old.HealthCheck, fw.HealthCheck) {
+		err := StopForward(old.Proto, old.FromPort)
+		if err != nil {
+			return errors.Wrap(err, "UpdateForward: failed to stop forwarding")
+		}
+		err = StartForward(fw)
+		if err != nil {
+			if rerr := StartForward(old); rerr != nil {
+				log.Println("Ignore StartForward error:", rerr)
+			}
+			return errors.Wrap(err, "UpdateForward: failed to start forwarding")
+		}
+	}
+
+	return WriteForwardFile(fw)
+}
+
+// removeForwards stops the forwardings and removes their settings files.
+func removeForwards(fws []*ForwardMetaData) error {
+	for _, fw := range fws {
+		err := StopForward(fw.Proto, fw.FromPort)
+		if err != nil {
+			// it may be already stopped by the concurrent request
+			log.Println("Ignore StopForward error:", err)
+		}
+		err = RemoveForwardFile(fw)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeForwardsToVM removes the forwardings whose destination is the VM.
+func removeForwardsToVM(name string) error {
+	fws, err := ReadAllForwardFiles()
+	if err != nil {
+		return err
+	}
+	targets := []*ForwardMetaData{}
+	for _, fw := range fws {
+		if fw.ToName == name {
+			targets = append(targets, fw)
+		}
+	}
+	return removeForwards(targets)
+}
+
+func isForwardExpired(fw *ForwardMetaData, now time.Time) bool {
+	if fw.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, fw.ExpiresAt)
+	if err != nil {
+		log.Printf("Ignore invalid expires_at of %s: %v\n", generateForwardID(fw.Proto, fw.FromPort), err)
+		return false
+	}
+	return !now.Before(expiresAt)
+}
+
+// ExpireForwards removes the forwardings which are expired.
+func ExpireForwards() error {
+	fws, err := ReadAllForwardFiles()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	targets := []*ForwardMetaData{}
+	for _, fw := range fws {
+		if isForwardExpired(fw, now) {
+			log.Printf("[forwarder] INFO remove expired forwarding %s\n", generateForwardID(fw.Proto, fw.FromPort))
+			targets = append(targets, fw)
+		}
 	}
-	for _, c := range channels {
-		c <- struct{}{}
+	return removeForwards(targets)
+}
+
+// WatchForwardExpiration removes the expired forwardings periodically.
+func WatchForwardExpiration() {
+	for {
+		time.Sleep(forwardExpirationInterval)
+		err := ExpireForwards()
+		if err != nil {
+			log.Println("Ignore ExpireForwards error:", err)
+		}
 	}
 }
 
+// UpdateIPAddressInForwarder updates the IP address associated to VM.
+func UpdateIPAddressInForwarder(name, ip string) {
+	defaultForwarder.UpdateAddress(name, ip)
+}
+
 // WriteForwardFile creates or updates the forwarding settings file.
 // The file name will be joined string of protocol and listen port.
 func WriteForwardFile(fw *ForwardMetaData) error {
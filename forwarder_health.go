@@ -0,0 +1,196 @@
+package minivmm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthCheckTCP checks the forward destination by TCP connect.
+	HealthCheckTCP = "tcp"
+	// HealthCheckHTTP checks the forward destination by HTTP GET. The status code less than 400 is healthy.
+	HealthCheckHTTP = "http"
+
+	// ForwardHealthUnknown is the status before the first check.
+	ForwardHealthUnknown = "unknown"
+	// ForwardHealthUp is the status when the last check succeeded.
+	ForwardHealthUp = "up"
+	// ForwardHealthDown is the status when the last check failed.
+	ForwardHealthDown = "down"
+
+	defaultHealthCheckInterval = 10
+	defaultHealthCheckTimeout  = 3
+)
+
+// ForwardHealthCheck is the active health check of the forward destination.
+type ForwardHealthCheck struct {
+	Type string `json:"type"`
+	// Path is the request path of HTTP check.
+	Path string `json:"path"`
+	// Interval and Timeout are in seconds.
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+}
+
+// ForwardHealth is the result of the latest health check.
+type ForwardHealth struct {
+	Status      string `json:"status"`
+	LastError   string `json:"last_error"`
+	LastChecked string `json:"last_checked"`
+}
+
+// forwardHealth holds the health of a running forwarding.
+type forwardHealth struct {
+	mu     sync.Mutex
+	health ForwardHealth
+}
+
+func (h *forwardHealth) set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.health.LastChecked = time.Now().Format(time.RFC3339)
+	if err != nil {
+		h.health.Status = ForwardHealthDown
+		h.health.LastError = err.Error()
+		return
+	}
+	h.health.Status = ForwardHealthUp
+}
+
+func (h *forwardHealth) get() *ForwardHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := h.health
+	return &ret
+}
+
+func validateHealthCheck(fw *ForwardMetaData) error {
+	hc := fw.HealthCheck
+	if hc == nil {
+		return nil
+	}
+	if hc.Type != HealthCheckTCP && hc.Type != HealthCheckHTTP {
+		return fmt.Errorf("unknown health check type: %s", hc.Type)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("invalid health check interval or timeout")
+	}
+	if fw.Type == "" && fw.Proto == "udp" {
+		return fmt.Errorf("health check is not supported by udp forwarding")
+	}
+	return nil
+}
+
+func getHealthCheckDurations(hc *ForwardHealthCheck) (time.Duration, time.Duration) {
+	interval, timeout := hc.Interval, hc.Timeout
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	return time.Duration(interval) * time.Second, time.Duration(timeout) * time.Second
+}
+
+// checkForwardHealth checks the destination once.
+func checkForwardHealth(ctx context.Context, hc *ForwardHealthCheck, addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch hc.Type {
+	case HealthCheckTCP:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthCheckHTTP:
+		path := hc.Path
+		if path == "" {
+			path = "/"
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{
+			// redirects are regarded as healthy
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("unhealthy status: %s", resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown health check type: %s", hc.Type)
+}
+
+// startHealthCheck starts the health check of the running forwarding. It's stopped with the forwarding.
+func (f *Forwarder) startHealthCheck(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, ok := f.forwards[id]
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := r.cancel
+	r.cancel = func() {
+		cancel()
+		stop()
+	}
+	r.health = &forwardHealth{health: ForwardHealth{Status: ForwardHealthUnknown}}
+	go f.checkHealth(ctx, r.fw, r.health)
+}
+
+func (f *Forwarder) checkHealth(ctx context.Context, fw *ForwardMetaData, h *forwardHealth) {
+	interval, timeout := getHealthCheckDurations(fw.HealthCheck)
+	for {
+		f.mu.Lock()
+		ip := f.addrs[fw.ToName]
+		f.mu.Unlock()
+
+		if ip == "" {
+			h.set(fmt.Errorf("IP address of %s is unknown", fw.ToName))
+		} else {
+			h.set(checkForwardHealth(ctx, fw.HealthCheck, net.JoinHostPort(ip, fw.ToPort), timeout))
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Health returns the health of the forwarding, or nil if it's not running or not checked.
+func (f *Forwarder) Health(proto, fromPort string) *ForwardHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, ok := f.forwards[generateForwardID(proto, fromPort)]
+	if !ok || r.health == nil {
+		return nil
+	}
+	return r.health.get()
+}
+
+// GetForwardHealth returns the health of the forwarding, or nil if it's not running or not checked.
+func GetForwardHealth(proto, fromPort string) *ForwardHealth {
+	return defaultForwarder.Health(proto, fromPort)
+}
@@ -0,0 +1,266 @@
+package minivmm
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ForwardTypeHTTP routes HTTP requests on the shared listener to the VM by Host header.
+	// FromPort of the HTTP forward is the host name instead of the port number.
+	ForwardTypeHTTP = "http"
+
+	forwardProtoHTTP = "http"
+)
+
+var validForwardHost = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// DefaultHTTPForwardHost returns the host name of the HTTP forward to the VM, like `<name>.<VMM_HTTP_PROXY_DOMAIN>`.
+func DefaultHTTPForwardHost(name string) string {
+	if C.HTTPProxyDomain == "" {
+		return name
+	}
+	return name + "." + C.HTTPProxyDomain
+}
+
+// validateForwardHostOwner checks the host name under the shared domain is `<vm name>.<domain>` (or its subdomain)
+// of the VM owned by the forward owner, not to let users take the host names of others' VMs.
+func validateForwardHostOwner(fw *ForwardMetaData) error {
+	if (fw.Type != ForwardTypeHTTP && fw.Type != ForwardTypeTLS) || C.HTTPProxyDomain == "" {
+		return nil
+	}
+	host := strings.ToLower(fw.FromPort)
+	domain := strings.ToLower(C.HTTPProxyDomain)
+	if host == domain {
+		return fmt.Errorf("host name '%s' is reserved", host)
+	}
+	if !strings.HasSuffix(host, "."+domain) {
+		return nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."+domain), ".")
+	vmName := labels[len(labels)-1]
+	vm, err := loadVMMetaData(vmName)
+	if err != nil || vm.Owner != fw.Owner {
+		return fmt.Errorf("host name '%s' must be '<vm name>.%s' of your own VM", host, domain)
+	}
+	return nil
+}
+
+func (f *Forwarder) startHTTP(id string, fw *ForwardMetaData) error {
+	if !validForwardHost.MatchString(fw.FromPort) {
+		return fmt.Errorf("invalid host name: %s", fw.FromPort)
+	}
+
+	limiter, err := newForwardLimiter(fw)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.forwards[id]; ok {
+		return fmt.Errorf("forwarding already exists: %s", id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningForward{
+		fw:          fw,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		addrChanged: make(chan struct{}, 1),
+		http:        true,
+		limiter:     limiter,
+		stats:       &forwardStats{},
+	}
+	close(r.done)
+	f.forwards[id] = r
+	return nil
+}
+
+// ServeHTTP proxies the request to the VM which the Host header is routed to.
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	f.mu.Lock()
+	r, ok := f.forwards[generateForwardID(forwardProtoHTTP, host)]
+	f.mu.Unlock()
+	if !ok || !r.http {
+		http.NotFound(w, req)
+		return
+	}
+
+	// the limits are applied to each request since the connection may be shared by keep-alive
+	var client net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		client = addr
+	}
+	if err := r.limiter.acquire(client); err != nil {
+		log.Printf("[forwarder] WARN reject request from %s: %s\n", req.RemoteAddr, err.Error())
+		r.stats.addError()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	defer r.limiter.release()
+
+	// each request is counted as a connection
+	r.stats.open()
+	defer r.stats.close()
+
+	// the request is aborted when the forwarding is stopped
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+
+	toIP, err := f.resolve(ctx, r.fw.ToName)
+	if err != nil {
+		log.Printf("[forwarder] WARN could not get IP address for %s\n", r.fw.ToName)
+		r.stats.addError()
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if req.Body != nil {
+		req.Body = &countingReadCloser{req.Body, r.stats.addIn}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	// X-Forwarded-For is appended by ReverseProxy, and upgraded connections like WebSocket are also proxied.
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = net.JoinHostPort(toIP, r.fw.ToPort)
+			out.Header.Set("X-Forwarded-Host", req.Host)
+			out.Header.Set("X-Forwarded-Proto", proto)
+			if _, ok := out.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				out.Header.Set("User-Agent", "")
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// the body of the upgraded connection must be kept as io.ReadWriteCloser
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				resp.Body = &countingReadCloser{resp.Body, r.stats.addOut}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Println("[forwarder] WARN http proxy error: ", err.Error())
+			r.stats.addError()
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+type cachedCertificate struct {
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// certificateCache keeps the parsed per-host certificates not to parse them on every handshake.
+// The entry is reloaded when the modification time of the certificate or key file is changed.
+type certificateCache struct {
+	mu    sync.Mutex
+	certs map[string]*cachedCertificate
+}
+
+func (c *certificateCache) get(certPath, keyPath string) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.certs[certPath]; ok && e.certMod.Equal(certInfo.ModTime()) && e.keyMod.Equal(keyInfo.ModTime()) {
+		return e.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	c.certs[certPath] = &cachedCertificate{cert: &cert, certMod: certInfo.ModTime(), keyMod: keyInfo.ModTime()}
+	return &cert, nil
+}
+
+// getHTTPProxyCertificate returns the per-host certificate in the cert dir (`<host>.crt` and `<host>.key`),
+// or the server certificate if it does not exist.
+func getHTTPProxyCertificate(defaultCert *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cache := &certificateCache{certs: map[string]*cachedCertificate{}}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(hello.ServerName)
+		if validForwardHost.MatchString(name) {
+			certPath := filepath.Join(C.CertDir, name+".crt")
+			keyPath := filepath.Join(C.CertDir, name+".key")
+			if _, err := os.Stat(certPath); err == nil {
+				return cache.get(certPath, keyPath)
+			}
+		}
+		if defaultCert == nil {
+			return nil, errors.Errorf("no certificate for '%s'", hello.ServerName)
+		}
+		return defaultCert, nil
+	}
+}
+
+func serveHTTPSProxy() error {
+	var defaultCert *tls.Certificate
+	if C.ServerCert != "" && C.ServerKey != "" {
+		cert, err := tls.LoadX509KeyPair(C.ServerCert, C.ServerKey)
+		if err != nil {
+			return err
+		}
+		defaultCert = &cert
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", C.HTTPSProxyPort),
+		Handler:   defaultForwarder,
+		TLSConfig: &tls.Config{GetCertificate: getHTTPProxyCertificate(defaultCert)},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// ServeHTTPProxy serves the shared listeners of HTTP forwards.
+func ServeHTTPProxy() {
+	if C.HTTPSProxyPort != 0 {
+		go func() {
+			log.Fatal(serveHTTPSProxy())
+		}()
+	}
+	if C.HTTPProxyPort != 0 {
+		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", C.HTTPProxyPort), defaultForwarder))
+	}
+}
@@ -0,0 +1,112 @@
+package minivmm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.Chtimes(certPath, modTime, modTime)
+	os.Chtimes(keyPath, modTime, modTime)
+}
+
+func TestHTTPProxyCertificateCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minivmm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	SetConfig(&Config{CertDir: dir})
+
+	getCert := getHTTPProxyCertificate(nil)
+	hello := &tls.ClientHelloInfo{ServerName: "vm1.example.com"}
+
+	writeTestCertificate(t, dir, "vm1.example.com", time.Now().Add(-time.Hour))
+	cert1, err := getCert(hello)
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	cert2, _ := getCert(hello)
+	if cert1 != cert2 {
+		t.Errorf("certificate is parsed again while the files are not changed")
+	}
+
+	// renewed certificate
+	writeTestCertificate(t, dir, "vm1.example.com", time.Now())
+	cert3, err := getCert(hello)
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	if cert3 == cert1 || string(cert3.Certificate[0]) == string(cert1.Certificate[0]) {
+		t.Errorf("renewed certificate is not reloaded")
+	}
+
+	if _, err := getCert(&tls.ClientHelloInfo{ServerName: "vm2.example.com"}); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestValidateForwardHostOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minivmm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	SetConfig(&Config{VMDir: dir, HTTPProxyDomain: "example.com"})
+	os.MkdirAll(filepath.Join(dir, "vm1"), 0755)
+	b, _ := json.Marshal(&VMMetaData{Name: "vm1", Owner: "user1"})
+	ioutil.WriteFile(filepath.Join(dir, "vm1", vmMetaDataFileName), b, 0644)
+
+	cases := []struct {
+		host  string
+		owner string
+		valid bool
+	}{
+		{"vm1.example.com", "user1", true},
+		{"app.vm1.example.com", "user1", true},
+		{"vm1.example.com", "user2", false},
+		{"vm2.example.com", "user1", false},
+		{"example.com", "user1", false},
+		{"www.example.org", "user2", true},
+	}
+	for _, c := range cases {
+		fw := &ForwardMetaData{Type: ForwardTypeHTTP, FromPort: c.host, Owner: c.owner}
+		err := validateForwardHostOwner(fw)
+		if (err == nil) != c.valid {
+			t.Errorf("unexpected validation result of host:%s owner:%s; err:%v", c.host, c.owner, err)
+		}
+	}
+}
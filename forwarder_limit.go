@@ -0,0 +1,201 @@
+package minivmm
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const forwardClientSweepInterval = time.Minute
+
+// errForwardDenied is returned when the connection is rejected by the forward limits.
+var errForwardDenied = errors.New("connection is denied by the forward limits")
+
+// forwardLimiter enforces the source allowlist and the connection limits of a forwarding.
+// The nil limiter allows everything.
+type forwardLimiter struct {
+	allowed  []*net.IPNet
+	maxConns int
+	// rate is the number of new connections per minute allowed for each client address.
+	rate int
+
+	mu        sync.Mutex
+	active    int
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+// clientBucket is the token bucket of the connection rate from a client.
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		if ip := net.ParseIP(c); ip != nil {
+			// a single address
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func validateForwardLimits(fw *ForwardMetaData) error {
+	allowed, err := parseCIDRs(fw.AllowedCIDRs)
+	if err != nil {
+		return err
+	}
+	if fw.MaxConnections < 0 {
+		return fmt.Errorf("invalid max connections: %d", fw.MaxConnections)
+	}
+	if fw.RateLimit < 0 {
+		return fmt.Errorf("invalid rate limit: %d", fw.RateLimit)
+	}
+	if fw.BindAddress != "" && net.ParseIP(fw.BindAddress) == nil {
+		return fmt.Errorf("invalid bind address: %s", fw.BindAddress)
+	}
+
+	switch {
+	case fw.Type == ForwardTypeHTTP || fw.Type == ForwardTypeTLS:
+		if fw.BindAddress != "" {
+			return fmt.Errorf("bind address is not supported by %s forwarding on the shared listener", fw.Type)
+		}
+	case getForwardBackend(fw) == ForwardBackendDNAT:
+		if fw.MaxConnections != 0 || fw.RateLimit != 0 {
+			return fmt.Errorf("connection limits are not supported by dnat forwarding")
+		}
+		if fw.BindAddress != "" && net.ParseIP(fw.BindAddress).To4() == nil {
+			return fmt.Errorf("dnat forwarding supports only ipv4")
+		}
+		for _, n := range allowed {
+			if n.IP.To4() == nil {
+				return fmt.Errorf("dnat forwarding supports only ipv4")
+			}
+		}
+	}
+	return nil
+}
+
+// newForwardLimiter returns the limiter of the forwarding, or nil if it has no limits.
+func newForwardLimiter(fw *ForwardMetaData) (*forwardLimiter, error) {
+	if len(fw.AllowedCIDRs) == 0 && fw.MaxConnections == 0 && fw.RateLimit == 0 {
+		return nil, nil
+	}
+	allowed, err := parseCIDRs(fw.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardLimiter{
+		allowed:  allowed,
+		maxConns: fw.MaxConnections,
+		rate:     fw.RateLimit,
+		clients:  map[string]*clientBucket{},
+	}, nil
+}
+
+func getAddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (l *forwardLimiter) isAllowed(ip net.IP) bool {
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, n := range l.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeToken consumes the rate limit token of the client. It must be called with the lock.
+func (l *forwardLimiter) takeToken(key string, now time.Time) bool {
+	if l.rate == 0 {
+		return true
+	}
+
+	if now.Sub(l.lastSweep) > forwardClientSweepInterval {
+		// the bucket not used for a minute is full, and it's the same as the absence of the bucket
+		for k, b := range l.clients {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.clients[key]
+	if !ok {
+		b = &clientBucket{tokens: float64(l.rate), last: now}
+		l.clients[key] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(l.rate)
+	if b.tokens > float64(l.rate) {
+		b.tokens = float64(l.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// acquire checks the new connection from the client, and counts it as active if it's accepted.
+// release must be called when the accepted connection is closed.
+func (l *forwardLimiter) acquire(client net.Addr) error {
+	if l == nil {
+		return nil
+	}
+	ip := getAddrIP(client)
+	if ip == nil {
+		return errForwardDenied
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.isAllowed(ip) {
+		return errForwardDenied
+	}
+	if l.maxConns != 0 && l.active >= l.maxConns {
+		return errForwardDenied
+	}
+	if !l.takeToken(ip.String(), time.Now()) {
+		return errForwardDenied
+	}
+	l.active++
+	return nil
+}
+
+func (l *forwardLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+}
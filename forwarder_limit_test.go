@@ -0,0 +1,115 @@
+package minivmm
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testClientAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestForwardLimiterAllowedCIDRs(t *testing.T) {
+	l, err := newForwardLimiter(&ForwardMetaData{AllowedCIDRs: []string{"192.0.2.0/24", "198.51.100.1", "2001:db8::/32"}})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %v", err)
+	}
+
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.10", true},
+		{"::ffff:192.0.2.10", true},
+		{"198.51.100.1", true},
+		{"198.51.100.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, c := range cases {
+		err := l.acquire(testClientAddr(c.ip))
+		if (err == nil) != c.allowed {
+			t.Errorf("unexpected result for %s; expected allowed:%v actual error:%v", c.ip, c.allowed, err)
+		}
+	}
+
+	if _, err := newForwardLimiter(&ForwardMetaData{AllowedCIDRs: []string{"invalid"}}); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestForwardLimiterMaxConnections(t *testing.T) {
+	l, _ := newForwardLimiter(&ForwardMetaData{MaxConnections: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(testClientAddr("192.0.2.1")); err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+	}
+	if err := l.acquire(testClientAddr("192.0.2.2")); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	l.release()
+	if err := l.acquire(testClientAddr("192.0.2.2")); err != nil {
+		t.Errorf("failed to acquire after release: %v", err)
+	}
+}
+
+func TestForwardLimiterRateLimit(t *testing.T) {
+	l, _ := newForwardLimiter(&ForwardMetaData{RateLimit: 2})
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.takeToken("192.0.2.1", now) || !l.takeToken("192.0.2.1", now) {
+		t.Fatalf("connections within the limit are rejected")
+	}
+	if l.takeToken("192.0.2.1", now) {
+		t.Errorf("connection over the limit is accepted")
+	}
+	// the limit is applied for each client
+	if !l.takeToken("192.0.2.2", now) {
+		t.Errorf("connection from another client is rejected")
+	}
+	// a token is refilled in 30 seconds
+	if !l.takeToken("192.0.2.1", now.Add(30*time.Second)) {
+		t.Errorf("connection after the refill is rejected")
+	}
+}
+
+func TestForwarderAllowedCIDRs(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	fw := newTestForward("tcp", fromPort, toPort)
+	fw.AllowedCIDRs = []string{"192.0.2.0/24"}
+	fw.BindAddress = "127.0.0.1"
+	if err := f.Start(fw); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+fromPort)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("hello\n"))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("connection from the address not allowed is not closed")
+	}
+
+	invalid := newTestForward("tcp", getFreePort(t), toPort)
+	invalid.Backend = ForwardBackendDNAT
+	invalid.RateLimit = 10
+	if err := f.Start(invalid); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
@@ -0,0 +1,114 @@
+package minivmm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// ProxyProtocolV1 prepends the human-readable PROXY protocol header to the upstream connection.
+	ProxyProtocolV1 = "v1"
+	// ProxyProtocolV2 prepends the binary PROXY protocol header to the upstream connection.
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func validateProxyProtocol(fw *ForwardMetaData) error {
+	switch fw.ProxyProtocol {
+	case "":
+		return nil
+	case ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("unknown proxy protocol version: %s", fw.ProxyProtocol)
+	}
+
+	if fw.Type == ForwardTypeHTTP {
+		return fmt.Errorf("proxy protocol is not supported by http forwarding, use X-Forwarded-For")
+	}
+	if fw.Type != ForwardTypeTLS {
+		if fw.Proto == "udp" {
+			return fmt.Errorf("proxy protocol supports only tcp")
+		}
+		if getForwardBackend(fw) == ForwardBackendDNAT {
+			return fmt.Errorf("proxy protocol is not supported by dnat forwarding, the client address is already preserved")
+		}
+	}
+	return nil
+}
+
+// getProxyProtocolAddrs returns the addresses in the same family, or nil if they are not TCP addresses.
+func getProxyProtocolAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	v4 := s.IP.To4() != nil && d.IP.To4() != nil
+	if v4 {
+		return &net.TCPAddr{IP: s.IP.To4(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To4(), Port: d.Port}, true
+	}
+	return &net.TCPAddr{IP: s.IP.To16(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To16(), Port: d.Port}, true
+}
+
+func generateProxyProtocolV1Header(src, dst net.Addr) []byte {
+	s, d, ok := getProxyProtocolAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if len(s.IP) == net.IPv4len {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+}
+
+func generateProxyProtocolV2Header(src, dst net.Addr) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(proxyProtocolV2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	s, d, ok := getProxyProtocolAddrs(src, dst)
+	if !ok {
+		// AF_UNSPEC, the upstream must ignore the address information
+		buf.WriteByte(0x00)
+		binary.Write(buf, binary.BigEndian, uint16(0))
+		return buf.Bytes()
+	}
+
+	if len(s.IP) == net.IPv4len {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+	} else {
+		// TCP over IPv6
+		buf.WriteByte(0x21)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(s.IP)*2+4))
+	buf.Write(s.IP)
+	buf.Write(d.IP)
+	binary.Write(buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
+
+// writeProxyProtocolHeader writes the PROXY protocol header telling the client address of the connection.
+func writeProxyProtocolHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = generateProxyProtocolV1Header(src, dst)
+	case ProxyProtocolV2:
+		header = generateProxyProtocolV2Header(src, dst)
+	default:
+		return fmt.Errorf("unknown proxy protocol version: %s", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
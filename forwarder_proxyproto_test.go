@@ -0,0 +1,108 @@
+package minivmm
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGenerateProxyProtocolV1Header(t *testing.T) {
+	cases := []struct {
+		src, dst net.Addr
+		expected string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+			&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8080},
+			"PROXY TCP4 192.0.2.1 198.51.100.1 40000 8080\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 40000 8080\r\n",
+		},
+		{
+			&net.UnixAddr{Name: "sock", Net: "unix"},
+			&net.UnixAddr{Name: "sock", Net: "unix"},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, c := range cases {
+		actual := string(generateProxyProtocolV1Header(c.src, c.dst))
+		if actual != c.expected {
+			t.Errorf("unexpected header; expected:%q actual:%q", c.expected, actual)
+		}
+	}
+}
+
+func TestGenerateProxyProtocolV2Header(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8080}
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+		0x9c, 0x40,
+		0x1f, 0x90,
+	)
+
+	actual := generateProxyProtocolV2Header(src, dst)
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("unexpected header; expected:%x actual:%x", expected, actual)
+	}
+}
+
+func TestForwarderProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+	toPort := strconv.Itoa(upstream.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	fw := newTestForward("tcp", fromPort, toPort)
+	fw.ProxyProtocol = ProxyProtocolV1
+	if err := f.Start(fw); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+fromPort)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	expected := "PROXY TCP4 127.0.0.1 127.0.0.1 " + strconv.Itoa(local.Port) + " " + fromPort + "\r\n"
+	select {
+	case actual := <-headers:
+		if actual != expected {
+			t.Errorf("unexpected header; expected:%q actual:%q", expected, actual)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("header is not received")
+	}
+
+	invalid := newTestForward("udp", getFreePort(t), toPort)
+	invalid.ProxyProtocol = ProxyProtocolV2
+	if err := f.Start(invalid); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
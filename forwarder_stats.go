@@ -0,0 +1,118 @@
+package minivmm
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ForwardStats is the traffic statistics of a forwarding since it's started.
+// Bytes in is the traffic from clients to the VM, and bytes out is the opposite.
+// The rejected connections by the forward limits are counted as errors.
+// DNAT forwardings are not counted since the traffic does not pass through minivmm.
+type ForwardStats struct {
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"active_connections"`
+	BytesIn           int64 `json:"bytes_in"`
+	BytesOut          int64 `json:"bytes_out"`
+	Errors            int64 `json:"errors"`
+}
+
+// forwardStats counts the traffic of a forwarding. The fields are accessed atomically.
+// The methods of the nil stats do nothing.
+type forwardStats struct {
+	connections int64
+	active      int64
+	bytesIn     int64
+	bytesOut    int64
+	errors      int64
+}
+
+func (s *forwardStats) open() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.connections, 1)
+	atomic.AddInt64(&s.active, 1)
+}
+
+func (s *forwardStats) close() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.active, -1)
+}
+
+func (s *forwardStats) addIn(n int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.bytesIn, int64(n))
+}
+
+func (s *forwardStats) addOut(n int) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.bytesOut, int64(n))
+}
+
+func (s *forwardStats) addError() {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.errors, 1)
+}
+
+func (s *forwardStats) snapshot() *ForwardStats {
+	if s == nil {
+		return &ForwardStats{}
+	}
+	return &ForwardStats{
+		Connections:       atomic.LoadInt64(&s.connections),
+		ActiveConnections: atomic.LoadInt64(&s.active),
+		BytesIn:           atomic.LoadInt64(&s.bytesIn),
+		BytesOut:          atomic.LoadInt64(&s.bytesOut),
+		Errors:            atomic.LoadInt64(&s.errors),
+	}
+}
+
+// countingWriter counts the written bytes by add.
+type countingWriter struct {
+	w   io.Writer
+	add func(int)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.add(n)
+	return n, err
+}
+
+// countingReadCloser counts the read bytes by add.
+type countingReadCloser struct {
+	io.ReadCloser
+	add func(int)
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.add(n)
+	return n, err
+}
+
+// Stats returns the statistics of the forwarding, or nil if it's not running.
+func (f *Forwarder) Stats(proto, fromPort string) *ForwardStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, ok := f.forwards[generateForwardID(proto, fromPort)]
+	if !ok {
+		return nil
+	}
+	return r.stats.snapshot()
+}
+
+// GetForwardStats returns the statistics of the forwarding, or nil if it's not running.
+func GetForwardStats(proto, fromPort string) *ForwardStats {
+	return defaultForwarder.Stats(proto, fromPort)
+}
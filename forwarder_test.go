@@ -0,0 +1,420 @@
+package minivmm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTCPEchoServer starts a TCP server replying the prefix and the received line.
+func startTCPEchoServer(t *testing.T, addr, prefix string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					fmt.Fprintf(conn, "%s%s\n", prefix, s.Text())
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// getFreePort returns a port number which is not used at the moment (for both TCP and UDP in practice).
+func getFreePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func testTCPRoundTrip(t *testing.T, port, msg, expected string) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	fmt.Fprintf(conn, "%s\n", msg)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read reply of '%s': %v", msg, err)
+	}
+	if reply != expected+"\n" {
+		t.Errorf("unexpected reply; expected:%s actual:%s", expected, reply)
+	}
+}
+
+func newTestForward(proto, fromPort, toPort string) *ForwardMetaData {
+	return &ForwardMetaData{Proto: proto, FromPort: fromPort, ToName: "vm1", ToPort: toPort}
+}
+
+func TestForwarderStartStop(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "echo:")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+
+	fromPort := getFreePort(t)
+	fw := newTestForward("tcp", fromPort, toPort)
+	err := f.Start(fw)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	testTCPRoundTrip(t, fromPort, "hello", "echo:hello")
+
+	if err := f.Start(fw); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	err = f.Stop("tcp", fromPort)
+	if err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:"+fromPort, time.Second); err == nil {
+		t.Errorf("listener is not closed")
+	}
+	if err := f.Stop("tcp", fromPort); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	// the port is released and can be used again
+	err = f.Start(fw)
+	if err != nil {
+		t.Fatalf("failed to restart: %v", err)
+	}
+	testTCPRoundTrip(t, fromPort, "again", "echo:again")
+	f.StopAll()
+}
+
+func TestForwarderWaitResolution(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	fromPort := getFreePort(t)
+	err := f.Start(newTestForward("tcp", fromPort, toPort))
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	// the address is given after the connection is accepted
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.UpdateAddress("vm1", "127.0.0.1")
+	}()
+	testTCPRoundTrip(t, fromPort, "hello", "hello")
+}
+
+func TestForwarderStopWhileResolving(t *testing.T) {
+	f := NewForwarder()
+	fromPort := getFreePort(t)
+	err := f.Start(newTestForward("tcp", fromPort, "1"))
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+fromPort)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		f.Stop("tcp", fromPort)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("stop is blocked by the session waiting for resolution")
+	}
+}
+
+func TestForwarderAddressChange(t *testing.T) {
+	echo1 := startTCPEchoServer(t, "127.0.0.1:0", "1:")
+	defer echo1.Close()
+	toPort := strconv.Itoa(echo1.Addr().(*net.TCPAddr).Port)
+	echo2 := startTCPEchoServer(t, "127.0.0.2:"+toPort, "2:")
+	defer echo2.Close()
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	err := f.Start(newTestForward("tcp", fromPort, toPort))
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	testTCPRoundTrip(t, fromPort, "a", "1:a")
+	f.UpdateAddress("vm1", "127.0.0.2")
+	testTCPRoundTrip(t, fromPort, "b", "2:b")
+}
+
+func TestForwarderUDPAddressChange(t *testing.T) {
+	echo1 := startUDPEchoServer(t, "1:")
+	defer echo1.Close()
+	toPort := strconv.Itoa(echo1.LocalAddr().(*net.UDPAddr).Port)
+	echo2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: echo1.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo2.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo2.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo2.WriteToUDP(append([]byte("2:"), buf[:n]...), addr)
+		}
+	}()
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	err = f.Start(newTestForward("udp", fromPort, toPort))
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	conn, err := net.Dial("udp", "127.0.0.1:"+fromPort)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	testUDPRoundTrip(t, conn.(*net.UDPConn), "a", "1:a")
+
+	f.UpdateAddress("vm1", "127.0.0.2")
+	// the update is applied asynchronously
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn.Write([]byte("b"))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err == nil && string(buf[:n]) == "2:b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("address change is not applied")
+		}
+	}
+}
+
+func TestForwarderConcurrentOperations(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	ports := []string{}
+	for i := 0; i < 4; i++ {
+		ports = append(ports, getFreePort(t))
+	}
+
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port string) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := f.Start(newTestForward("tcp", port, toPort)); err != nil {
+					t.Errorf("failed to start: %v", err)
+					return
+				}
+				if err := f.Stop("tcp", port); err != nil {
+					t.Errorf("failed to stop: %v", err)
+					return
+				}
+			}
+		}(port)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.UpdateAddress("vm1", fmt.Sprintf("127.0.0.%d", i%2+1))
+		}
+	}()
+	wg.Wait()
+
+	f.StopAll()
+}
+
+func TestIsForwardExpired(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		expiresAt string
+		expected  bool
+	}{
+		{"", false},
+		{"2020-01-01T00:00:01Z", false},
+		{"2020-01-01T00:00:00Z", true},
+		{"2019-12-31T23:59:59Z", true},
+		{"invalid", false},
+	}
+	for _, c := range cases {
+		fw := &ForwardMetaData{Proto: "tcp", FromPort: "10022", ExpiresAt: c.expiresAt}
+		if actual := isForwardExpired(fw, now); actual != c.expected {
+			t.Errorf("unexpected result for '%s'; expected:%v actual:%v", c.expiresAt, c.expected, actual)
+		}
+	}
+}
+
+func TestForwarderStats(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "echo:")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	if err := f.Start(newTestForward("tcp", fromPort, toPort)); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	testTCPRoundTrip(t, fromPort, "hello", "echo:hello")
+	testTCPRoundTrip(t, fromPort, "hello", "echo:hello")
+
+	// the session is finished asynchronously after the client is closed
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s := f.Stats("tcp", fromPort)
+		if s.ActiveConnections == 0 {
+			if s.Connections != 2 || s.BytesIn != 12 || s.BytesOut != 22 || s.Errors != 0 {
+				t.Errorf("unexpected stats: %+v", s)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions are not finished: %+v", s)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if s := f.Stats("tcp", getFreePort(t)); s != nil {
+		t.Errorf("stats of unknown forwarding is returned: %+v", s)
+	}
+}
+
+func TestForwarderHealthCheck(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "")
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fromPort := getFreePort(t)
+	fw := newTestForward("tcp", fromPort, toPort)
+	fw.HealthCheck = &ForwardHealthCheck{Type: HealthCheckTCP}
+	if err := f.Start(fw); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	// the first check is run immediately
+	deadline := time.Now().Add(3 * time.Second)
+	for f.Health("tcp", fromPort).Status != ForwardHealthUp {
+		if time.Now().After(deadline) {
+			t.Fatalf("health check does not succeed: %+v", f.Health("tcp", fromPort))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	echo.Close()
+	hc := &ForwardHealthCheck{Type: HealthCheckTCP}
+	if err := checkForwardHealth(context.Background(), hc, "127.0.0.1:"+toPort, time.Second); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	invalid := newTestForward("udp", getFreePort(t), toPort)
+	invalid.HealthCheck = hc
+	if err := f.Start(invalid); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestCheckForwardHealthHTTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	cases := []struct {
+		path    string
+		healthy bool
+	}{
+		{"/healthz", true},
+		{"/redirect", true},
+		{"/", false},
+	}
+	for _, c := range cases {
+		hc := &ForwardHealthCheck{Type: HealthCheckHTTP, Path: c.path}
+		err := checkForwardHealth(context.Background(), hc, ln.Addr().String(), time.Second)
+		if (err == nil) != c.healthy {
+			t.Errorf("unexpected result for %s; expected healthy:%v actual error:%v", c.path, c.healthy, err)
+		}
+	}
+}
+
+func TestForwarderDNATPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	f := NewForwarder()
+	fw := newTestForward("tcp", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), "80")
+	fw.Backend = ForwardBackendDNAT
+	fw.BindAddress = "127.0.0.1"
+	if err := f.Start(fw); err == nil {
+		t.Errorf("dnat forwarding takes over the port in use")
+	}
+
+	fw = newTestForward("tcp", getFreePort(t), "80")
+	fw.Backend = ForwardBackendDNAT
+	if err := f.Start(fw); err != nil {
+		t.Errorf("failed to start dnat forwarding: %v", err)
+	}
+	f.StopAll()
+}
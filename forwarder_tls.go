@@ -0,0 +1,165 @@
+package minivmm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ForwardTypeTLS routes TLS connections on the shared listener to the VM by SNI without decrypting.
+	// FromPort of the TLS forward is the server name instead of the port number.
+	ForwardTypeTLS = "tls"
+
+	forwardProtoTLS        = "tls"
+	clientHelloReadTimeout = 5 * time.Second
+)
+
+// readOnlyConn passes the read data to crypto/tls and discards its writes.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// prefixedConn is a connection whose already read bytes are put back.
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// peekClientHello returns the SNI server name in the TLS ClientHello and the reader which replays the read bytes.
+func peekClientHello(r io.Reader) (string, io.Reader, error) {
+	buf := new(bytes.Buffer)
+	var serverName string
+	found := false
+
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			found = true
+			// abort the handshake, the rest is handled by the VM
+			return nil, io.EOF
+		},
+	}
+	err := tls.Server(readOnlyConn{io.TeeReader(r, buf)}, config).Handshake()
+	if !found {
+		return "", nil, err
+	}
+	return strings.ToLower(serverName), io.MultiReader(buf, r), nil
+}
+
+func (f *Forwarder) startTLS(id string, fw *ForwardMetaData) error {
+	if !validForwardHost.MatchString(fw.FromPort) {
+		return fmt.Errorf("invalid server name: %s", fw.FromPort)
+	}
+
+	limiter, err := newForwardLimiter(fw)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.forwards[id]; ok {
+		return fmt.Errorf("forwarding already exists: %s", id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningForward{
+		fw:          fw,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		addrChanged: make(chan struct{}, 1),
+		tls:         true,
+		limiter:     limiter,
+		stats:       &forwardStats{},
+	}
+	close(r.done)
+	f.forwards[id] = r
+	return nil
+}
+
+// serveTLSPassthrough accepts TLS connections and splices them to the VMs routed by SNI.
+func (f *Forwarder) serveTLSPassthrough(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Println("[forwarder] WARN listen temporary error: ", err.Error())
+				continue
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.handleTLSPassthrough(conn)
+		}()
+	}
+}
+
+func (f *Forwarder) handleTLSPassthrough(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloReadTimeout))
+	serverName, reader, err := peekClientHello(conn)
+	if err != nil {
+		log.Println("[forwarder] WARN failed to read ClientHello: ", err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	f.mu.Lock()
+	r, ok := f.forwards[generateForwardID(forwardProtoTLS, serverName)]
+	f.mu.Unlock()
+	if !ok || !r.tls {
+		log.Printf("[forwarder] WARN no tls forwarding for '%s'\n", serverName)
+		conn.Close()
+		return
+	}
+
+	if err := r.limiter.acquire(conn.RemoteAddr()); err != nil {
+		log.Printf("[forwarder] WARN reject connection from %s: %s\n", conn.RemoteAddr(), err.Error())
+		r.stats.addError()
+		conn.Close()
+		return
+	}
+	defer r.limiter.release()
+
+	f.proxyTCPSession(r.ctx, &prefixedConn{conn, reader}, r)
+}
+
+// ServeTLSPassthrough serves the shared listener of TLS forwards.
+func ServeTLSPassthrough() {
+	if C.TLSPassthroughPort == 0 {
+		return
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", C.TLSPassthroughPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(defaultForwarder.serveTLSPassthrough(ln))
+}
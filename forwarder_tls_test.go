@@ -0,0 +1,118 @@
+package minivmm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recordClientHello returns the ClientHello bytes sent by the TLS client.
+func recordClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		c.Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16384)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read ClientHello: %v", err)
+	}
+	server.Close()
+	return buf[:n]
+}
+
+func TestPeekClientHello(t *testing.T) {
+	hello := recordClientHello(t, "VM1.example.com")
+
+	serverName, reader, err := peekClientHello(bytes.NewReader(hello))
+	if err != nil {
+		t.Fatalf("failed to peek: %v", err)
+	}
+	if serverName != "vm1.example.com" {
+		t.Errorf("unexpected server name; expected:vm1.example.com actual:%s", serverName)
+	}
+	replayed, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(replayed, hello) {
+		t.Errorf("peeked bytes are not replayed")
+	}
+
+	if _, _, err := peekClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
+
+func TestForwarderTLSPassthrough(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder()
+	f.UpdateAddress("vm1", "127.0.0.1")
+	fw := newTestForward("", "vm1.example.com", toPort)
+	fw.Type = ForwardTypeTLS
+	if err := f.Start(fw); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer f.StopAll()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go f.serveTLSPassthrough(ln)
+
+	// the ClientHello is spliced to the VM without modification
+	hello := recordClientHello(t, "vm1.example.com")
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write(hello)
+
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Errorf("ClientHello is modified")
+	}
+
+	// the connection with unknown server name is closed
+	unknown, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer unknown.Close()
+	unknown.SetDeadline(time.Now().Add(3 * time.Second))
+	unknown.Write(recordClientHello(t, "unknown.example.com"))
+	if _, err := unknown.Read(buf); err == nil {
+		t.Errorf("connection is not closed")
+	}
+}
@@ -0,0 +1,201 @@
+package minivmm
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpSessionIdleTimeout = 60 * time.Second
+	udpMaxDatagramSize    = 65535
+	// udpMaxSessions bounds the goroutines and sockets created by spoofed clients even if max_connections is not set.
+	udpMaxSessions = 1024
+)
+
+// udpProxy forwards datagrams from the listener to the upstream.
+// Each client address has its own session with a dedicated upstream socket,
+// so replies from the upstream are returned to the client which sent the request.
+type udpProxy struct {
+	listener    *net.UDPConn
+	idleTimeout time.Duration
+	maxSessions int
+	// limiter is applied when a new session is created.
+	limiter *forwardLimiter
+	// stats counts each session as a connection.
+	stats *forwardStats
+
+	mu       sync.Mutex
+	upstream string
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	client     *net.UDPAddr
+	conn       *net.UDPConn
+	lastActive int64 // unix nano, accessed atomically
+}
+
+func newUDPProxy(listener *net.UDPConn, upstream string, idleTimeout time.Duration) *udpProxy {
+	return &udpProxy{
+		listener:    listener,
+		idleTimeout: idleTimeout,
+		maxSessions: udpMaxSessions,
+		upstream:    upstream,
+		sessions:    map[string]*udpSession{},
+	}
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// serve reads datagrams from clients until the listener is closed.
+func (p *udpProxy) serve() {
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, client, err := p.listener.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Println("[forwarder] WARN udp read temporary error: ", err.Error())
+				continue
+			}
+			log.Println("[forwarder] INFO shutdown udp listener")
+			return
+		}
+
+		s, err := p.getSession(client)
+		if err == errForwardDenied {
+			// not logged since it's called for every datagram
+			p.stats.addError()
+			continue
+		} else if err != nil {
+			log.Println("[forwarder] WARN DialUDP error: ", err.Error())
+			p.stats.addError()
+			continue
+		}
+		s.touch()
+		written, err := s.conn.Write(buf[:n])
+		if err != nil {
+			log.Println("[forwarder] WARN udp write error: ", err.Error())
+			p.stats.addError()
+		}
+		p.stats.addIn(written)
+	}
+}
+
+func (p *udpProxy) getSession(client *net.UDPAddr) (*udpSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := client.String()
+	if s, ok := p.sessions[key]; ok {
+		return s, nil
+	}
+
+	if len(p.sessions) >= p.maxSessions {
+		return nil, errForwardDenied
+	}
+	if err := p.limiter.acquire(client); err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", p.upstream)
+	if err != nil {
+		p.limiter.release()
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		p.limiter.release()
+		return nil, err
+	}
+
+	s := &udpSession{client: client, conn: conn}
+	s.touch()
+	p.sessions[key] = s
+	p.stats.open()
+	go p.reply(s)
+	return s, nil
+}
+
+// reply returns the datagrams from the upstream to the client until the session is idle or closed.
+func (p *udpProxy) reply(s *udpSession) {
+	defer p.removeSession(s)
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				if s.idle() < p.idleTimeout {
+					// the client is still sending
+					continue
+				}
+				return
+			}
+			// closed by setUpstream/close, or the upstream is unreachable
+			return
+		}
+
+		s.touch()
+		written, err := p.listener.WriteToUDP(buf[:n], s.client)
+		if err != nil {
+			log.Println("[forwarder] WARN udp reply error: ", err.Error())
+			p.stats.addError()
+		}
+		p.stats.addOut(written)
+	}
+}
+
+func (p *udpProxy) removeSession(s *udpSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.conn.Close()
+	key := s.client.String()
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+		p.limiter.release()
+		p.stats.close()
+	}
+}
+
+func (p *udpProxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// setUpstream changes the upstream address. The existing sessions are closed and recreated for the new upstream.
+func (p *udpProxy) setUpstream(upstream string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.upstream = upstream
+	p.closeSessions()
+}
+
+func (p *udpProxy) closeSessions() {
+	for key, s := range p.sessions {
+		s.conn.Close()
+		delete(p.sessions, key)
+		p.limiter.release()
+		p.stats.close()
+	}
+}
+
+// close stops the listener and all sessions.
+func (p *udpProxy) close() {
+	p.listener.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeSessions()
+}
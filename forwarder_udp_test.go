@@ -0,0 +1,165 @@
+package minivmm
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEchoServer starts a UDP server replying the prefix and the received payload.
+func startUDPEchoServer(t *testing.T, prefix string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte(prefix), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+func startTestUDPProxy(t *testing.T, upstream string, idleTimeout time.Duration) *udpProxy {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	p := newUDPProxy(ln, upstream, idleTimeout)
+	go p.serve()
+	return p
+}
+
+func dialTestUDPProxy(t *testing.T, p *udpProxy) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, p.listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	return conn
+}
+
+func testUDPRoundTrip(t *testing.T, conn *net.UDPConn, msg, expected string) {
+	_, err := conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply of '%s': %v", msg, err)
+	}
+	if string(buf[:n]) != expected {
+		t.Errorf("unexpected reply; expected:%s actual:%s", expected, string(buf[:n]))
+	}
+}
+
+func TestUDPProxyMultipleClients(t *testing.T) {
+	echo := startUDPEchoServer(t, "echo:")
+	defer echo.Close()
+	p := startTestUDPProxy(t, echo.LocalAddr().String(), time.Minute)
+	defer p.close()
+
+	c1 := dialTestUDPProxy(t, p)
+	defer c1.Close()
+	c2 := dialTestUDPProxy(t, p)
+	defer c2.Close()
+
+	// replies must be routed back to each sender
+	testUDPRoundTrip(t, c1, "client1", "echo:client1")
+	testUDPRoundTrip(t, c2, "client2", "echo:client2")
+	testUDPRoundTrip(t, c1, "client1-again", "echo:client1-again")
+
+	if n := p.sessionCount(); n != 2 {
+		t.Errorf("unexpected session count; expected:2 actual:%d", n)
+	}
+}
+
+func TestUDPProxyIdleTimeout(t *testing.T) {
+	echo := startUDPEchoServer(t, "")
+	defer echo.Close()
+	p := startTestUDPProxy(t, echo.LocalAddr().String(), 100*time.Millisecond)
+	defer p.close()
+
+	c := dialTestUDPProxy(t, p)
+	defer c.Close()
+	testUDPRoundTrip(t, c, "hello", "hello")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for p.sessionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle session is not removed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a new session is created for the same client
+	testUDPRoundTrip(t, c, "hello", "hello")
+	if n := p.sessionCount(); n != 1 {
+		t.Errorf("unexpected session count; expected:1 actual:%d", n)
+	}
+}
+
+func TestUDPProxySetUpstream(t *testing.T) {
+	echo1 := startUDPEchoServer(t, "1:")
+	defer echo1.Close()
+	echo2 := startUDPEchoServer(t, "2:")
+	defer echo2.Close()
+	p := startTestUDPProxy(t, echo1.LocalAddr().String(), time.Minute)
+	defer p.close()
+
+	c := dialTestUDPProxy(t, p)
+	defer c.Close()
+	testUDPRoundTrip(t, c, "a", "1:a")
+
+	p.setUpstream(echo2.LocalAddr().String())
+	testUDPRoundTrip(t, c, "b", "2:b")
+}
+
+func TestUDPProxyClose(t *testing.T) {
+	echo := startUDPEchoServer(t, "")
+	defer echo.Close()
+	p := startTestUDPProxy(t, echo.LocalAddr().String(), time.Minute)
+
+	c := dialTestUDPProxy(t, p)
+	defer c.Close()
+	testUDPRoundTrip(t, c, "hello", "hello")
+
+	p.close()
+	if n := p.sessionCount(); n != 0 {
+		t.Errorf("unexpected session count; expected:0 actual:%d", n)
+	}
+}
+
+func TestUDPProxyMaxSessions(t *testing.T) {
+	echo := startUDPEchoServer(t, "echo:")
+	defer echo.Close()
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	p := newUDPProxy(ln, echo.LocalAddr().String(), time.Minute)
+	p.maxSessions = 1
+	go p.serve()
+	defer p.close()
+
+	c1 := dialTestUDPProxy(t, p)
+	defer c1.Close()
+	c2 := dialTestUDPProxy(t, p)
+	defer c2.Close()
+
+	testUDPRoundTrip(t, c1, "client1", "echo:client1")
+	c2.Write([]byte("client2"))
+	c2.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := c2.Read(make([]byte, 1500)); err == nil {
+		t.Errorf("session exceeding the limit is created")
+	}
+	if n := p.sessionCount(); n != 1 {
+		t.Errorf("unexpected session count; expected:1 actual:%d", n)
+	}
+}
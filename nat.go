@@ -0,0 +1,318 @@
+package minivmm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var (
+	nftTableName         = "minivmm"
+	iptablesNATChain     = "MINIVMM-POSTROUTING"
+	iptablesDNATChain    = "MINIVMM-PREROUTING"
+	iptablesForwardChain = "MINIVMM-FORWARD"
+	iptablesInputChain   = "MINIVMM-INPUT"
+	hostRulesFilePattern = "host-rules-*.nft"
+	// hostRulesMutex serializes applyHostRules not to load a stale ruleset over the latest one.
+	hostRulesMutex sync.Mutex
+)
+
+// hostRules is the netfilter configuration of the host (root netns) for VM networks.
+type hostRules struct {
+	masqueradeCIDRs []string
+	// isolatedIFs cannot reach other networks nor the host except DHCP, ICMPv6 and replies of the host's connections.
+	isolatedIFs []string
+	// privateIFs maps the host side interface of a private network to the interfaces of other networks.
+	privateIFs map[string][]string
+	dnats      []dnatRule
+	ipv6       bool
+}
+
+// dnatRule forwards the traffic to the host port to the VM in kernel.
+type dnatRule struct {
+	proto    string
+	fromPort string
+	toIP     string
+	toPort   string
+	// srcCIDRs restricts the client addresses if it's not empty.
+	srcCIDRs []string
+	// bindIP restricts the destination address if it's not empty.
+	bindIP string
+}
+
+func useNftables() bool {
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+func generateHostRules(nws []*NetworkMetaData) *hostRules {
+	r := &hostRules{privateIFs: map[string][]string{}, dnats: defaultForwarder.dnatRules()}
+	routed := []*NetworkMetaData{}
+	for _, nw := range nws {
+		if !isBridgedNetwork(nw) {
+			routed = append(routed, nw)
+		}
+	}
+	nws = routed
+
+	for _, nw := range nws {
+		if !nw.Private {
+			continue
+		}
+		_, veths := getNetworkIFNames(nw)
+		others := []string{}
+		for _, other := range nws {
+			if other.Name == nw.Name {
+				continue
+			}
+			_, otherVeths := getNetworkIFNames(other)
+			others = append(others, otherVeths[0])
+		}
+		r.privateIFs[veths[0]] = others
+	}
+	for _, nw := range nws {
+		_, veths := getNetworkIFNames(nw)
+		if nw.NAT {
+			r.masqueradeCIDRs = append(r.masqueradeCIDRs, nw.CIDR)
+		}
+		if nw.Isolated {
+			r.isolatedIFs = append(r.isolatedIFs, veths[0])
+		}
+		if nw.CIDR6 != "" {
+			r.ipv6 = true
+		}
+	}
+	return r
+}
+
+// applyHostRules enables IP forwarding and replaces the NAT/forward rules for all networks.
+// Rules are kept in minivmm's own nftables tables or iptables chains, so applying them is idempotent.
+func applyHostRules() error {
+	hostRulesMutex.Lock()
+	defer hostRulesMutex.Unlock()
+
+	nws, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	r := generateHostRules(nws)
+
+	cmds := [][]string{
+		{"sudo", "sysctl", "-w", "net.ipv4.ip_forward=1"},
+	}
+	if r.ipv6 {
+		cmds = append(cmds, []string{"sudo", "sysctl", "-w", "net.ipv6.conf.all.forwarding=1"})
+	}
+	err = Execs(cmds)
+	if err != nil {
+		return err
+	}
+
+	if useNftables() {
+		return applyNftRules(r)
+	}
+	return applyIptablesRules(r)
+}
+
+// removeHostRules removes all rules added by applyHostRules.
+func removeHostRules() {
+	if useNftables() {
+		ExecsIgnoreErr([][]string{
+			{"sudo", "nft", "delete", "table", "ip", nftTableName},
+			{"sudo", "nft", "delete", "table", "inet", nftTableName},
+		})
+		return
+	}
+
+	ExecsIgnoreErr([][]string{
+		{"sudo", "iptables", "-t", "nat", "-D", "PREROUTING", "-j", iptablesDNATChain},
+		{"sudo", "iptables", "-t", "nat", "-F", iptablesDNATChain},
+		{"sudo", "iptables", "-t", "nat", "-X", iptablesDNATChain},
+	})
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		ExecsIgnoreErr([][]string{
+			{"sudo", cmd, "-D", "FORWARD", "-j", iptablesForwardChain},
+			{"sudo", cmd, "-F", iptablesForwardChain},
+			{"sudo", cmd, "-X", iptablesForwardChain},
+			{"sudo", cmd, "-D", "INPUT", "-j", iptablesInputChain},
+			{"sudo", cmd, "-F", iptablesInputChain},
+			{"sudo", cmd, "-X", iptablesInputChain},
+		})
+	}
+	ExecsIgnoreErr([][]string{
+		{"sudo", "iptables", "-t", "nat", "-D", "POSTROUTING", "-j", iptablesNATChain},
+		{"sudo", "iptables", "-t", "nat", "-F", iptablesNATChain},
+		{"sudo", "iptables", "-t", "nat", "-X", iptablesNATChain},
+	})
+}
+
+func renderNftRules(r *hostRules) string {
+	b := &strings.Builder{}
+
+	// declare and delete tables first to replace existing rules atomically
+	fmt.Fprintf(b, "table ip %s\ndelete table ip %s\n", nftTableName, nftTableName)
+	fmt.Fprintf(b, "table inet %s\ndelete table inet %s\n", nftTableName, nftTableName)
+
+	fmt.Fprintf(b, "table ip %s {\n", nftTableName)
+	// only the traffic from outside is forwarded, the host itself connects to VMs directly
+	fmt.Fprintf(b, "\tchain prerouting {\n\t\ttype nat hook prerouting priority -100; policy accept;\n")
+	for _, d := range r.dnats {
+		match := "fib daddr type local"
+		if d.bindIP != "" {
+			match = "ip daddr " + d.bindIP
+		}
+		if len(d.srcCIDRs) != 0 {
+			match += fmt.Sprintf(" ip saddr { %s }", strings.Join(d.srcCIDRs, ", "))
+		}
+		fmt.Fprintf(b, "\t\t%s %s dport %s dnat to %s\n", match, d.proto, d.fromPort, net.JoinHostPort(d.toIP, d.toPort))
+	}
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, c := range r.masqueradeCIDRs {
+		fmt.Fprintf(b, "\t\tip saddr %s ip daddr != %s masquerade\n", c, c)
+	}
+	fmt.Fprintf(b, "\t}\n}\n")
+
+	fmt.Fprintf(b, "table inet %s {\n", nftTableName)
+	fmt.Fprintf(b, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	for _, ifName := range r.isolatedIFs {
+		fmt.Fprintf(b, "\t\tiifname \"%s\" drop\n", ifName)
+		fmt.Fprintf(b, "\t\toifname \"%s\" drop\n", ifName)
+	}
+	for ifName, others := range r.privateIFs {
+		for _, other := range others {
+			fmt.Fprintf(b, "\t\tiifname \"%s\" oifname \"%s\" drop\n", ifName, other)
+			fmt.Fprintf(b, "\t\tiifname \"%s\" oifname \"%s\" drop\n", other, ifName)
+		}
+	}
+	fmt.Fprintf(b, "\t}\n")
+	// the host is also unreachable from isolated networks except DHCP and IPv6 neighbor discovery
+	fmt.Fprintf(b, "\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n")
+	for _, ifName := range r.isolatedIFs {
+		fmt.Fprintf(b, "\t\tiifname \"%s\" ct state established,related accept\n", ifName)
+		fmt.Fprintf(b, "\t\tiifname \"%s\" udp dport 67 accept\n", ifName)
+		fmt.Fprintf(b, "\t\tiifname \"%s\" meta l4proto ipv6-icmp accept\n", ifName)
+		fmt.Fprintf(b, "\t\tiifname \"%s\" drop\n", ifName)
+	}
+	fmt.Fprintf(b, "\t}\n}\n")
+
+	return b.String()
+}
+
+// writeNftRulesFile writes the rules into a unique temporary file, which must be removed by the caller.
+func writeNftRulesFile(pattern, rules string) (string, error) {
+	f, err := ioutil.TempFile(C.Dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(rules)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func applyNftRules(r *hostRules) error {
+	path, err := writeNftRulesFile(hostRulesFilePattern, renderNftRules(r))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return Execs([][]string{
+		{"sudo", "nft", "-f", path},
+	})
+}
+
+func ensureIptablesChain(cmd, table, parent, chain string) error {
+	// the chain may already exist
+	ExecsIgnoreErr([][]string{
+		{"sudo", cmd, "-t", table, "-N", chain},
+	})
+	err := Execs([][]string{
+		{"sudo", cmd, "-t", table, "-F", chain},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = Execs([][]string{
+		{"sudo", cmd, "-t", table, "-C", parent, "-j", chain},
+	})
+	if err == nil {
+		return nil
+	}
+	return Execs([][]string{
+		{"sudo", cmd, "-t", table, "-I", parent, "-j", chain},
+	})
+}
+
+func applyIptablesRules(r *hostRules) error {
+	err := ensureIptablesChain("iptables", "nat", "POSTROUTING", iptablesNATChain)
+	if err != nil {
+		return err
+	}
+	err = ensureIptablesChain("iptables", "nat", "PREROUTING", iptablesDNATChain)
+	if err != nil {
+		return err
+	}
+	cmds := [][]string{}
+	for _, d := range r.dnats {
+		cmd := []string{"sudo", "iptables", "-t", "nat", "-A", iptablesDNATChain, "-p", d.proto, "--dport", d.fromPort}
+		if d.bindIP != "" {
+			cmd = append(cmd, "-d", d.bindIP)
+		} else {
+			cmd = append(cmd, "-m", "addrtype", "--dst-type", "LOCAL")
+		}
+		if len(d.srcCIDRs) != 0 {
+			cmd = append(cmd, "-s", strings.Join(d.srcCIDRs, ","))
+		}
+		cmds = append(cmds, append(cmd, "-j", "DNAT", "--to-destination", net.JoinHostPort(d.toIP, d.toPort)))
+	}
+	for _, c := range r.masqueradeCIDRs {
+		cmds = append(cmds, []string{"sudo", "iptables", "-t", "nat", "-A", iptablesNATChain, "-s", c, "!", "-d", c, "-j", "MASQUERADE"})
+	}
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		err = ensureIptablesChain(cmd, "filter", "FORWARD", iptablesForwardChain)
+		if err != nil {
+			if cmd == "ip6tables" && !r.ipv6 {
+				log.Println("Ignore ip6tables error:", err)
+				continue
+			}
+			return err
+		}
+		err = ensureIptablesChain(cmd, "filter", "INPUT", iptablesInputChain)
+		if err != nil {
+			return err
+		}
+		for _, ifName := range r.isolatedIFs {
+			cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesForwardChain, "-i", ifName, "-j", "DROP"})
+			cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesForwardChain, "-o", ifName, "-j", "DROP"})
+			cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesInputChain, "-i", ifName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"})
+			if cmd == "iptables" {
+				cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesInputChain, "-i", ifName, "-p", "udp", "--dport", "67", "-j", "ACCEPT"})
+			} else {
+				cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesInputChain, "-i", ifName, "-p", "ipv6-icmp", "-j", "ACCEPT"})
+			}
+			cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesInputChain, "-i", ifName, "-j", "DROP"})
+		}
+		for ifName, others := range r.privateIFs {
+			for _, other := range others {
+				cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesForwardChain, "-i", ifName, "-o", other, "-j", "DROP"})
+				cmds = append(cmds, []string{"sudo", cmd, "-A", iptablesForwardChain, "-i", other, "-o", ifName, "-j", "DROP"})
+			}
+		}
+	}
+
+	return Execs(cmds)
+}
@@ -0,0 +1,25 @@
+package minivmm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderNftRulesIsolated(t *testing.T) {
+	r := &hostRules{isolatedIFs: []string{"nw-iso"}, privateIFs: map[string][]string{}}
+	rules := renderNftRules(r)
+
+	expected := []string{
+		"\t\tiifname \"nw-iso\" drop\n\t\toifname \"nw-iso\" drop\n",
+		"\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n" +
+			"\t\tiifname \"nw-iso\" ct state established,related accept\n" +
+			"\t\tiifname \"nw-iso\" udp dport 67 accept\n" +
+			"\t\tiifname \"nw-iso\" meta l4proto ipv6-icmp accept\n" +
+			"\t\tiifname \"nw-iso\" drop\n\t}\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(rules, e) {
+			t.Errorf("rules do not contain %q:\n%s", e, rules)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package minivmm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultNICModel = "virtio-net-pci"
+
+var supportedNICModels = map[string]struct{}{
+	"virtio-net-pci": struct{}{},
+	"e1000":          struct{}{},
+	"e1000e":         struct{}{},
+	"rtl8139":        struct{}{},
+}
+
+func getNICDeviceID(nic *NIC) string {
+	return "dev-" + nic.ID
+}
+
+// nextNICID returns the smallest unused NIC ID. The ID is used as qemu netdev ID and for tap interface name.
+func nextNICID(nics []NIC) string {
+	used := map[string]struct{}{}
+	for _, nic := range nics {
+		used[nic.ID] = struct{}{}
+	}
+	for i := 0; ; i++ {
+		id := "net" + strconv.Itoa(i)
+		if _, ok := used[id]; !ok {
+			return id
+		}
+	}
+}
+
+// prepareNIC validates the NIC settings and fills its ID and MAC address.
+func prepareNIC(nic NIC, existing []NIC) (*NIC, error) {
+	if nic.Network == "" {
+		nic.Network = DefaultNetworkName
+	}
+	nw, err := GetNetwork(nic.Network)
+	if err != nil {
+		return nil, fmt.Errorf("network '%s' does not exist", nic.Network)
+	}
+
+	if nic.Model == "" {
+		nic.Model = defaultNICModel
+	}
+	if _, ok := supportedNICModels[nic.Model]; !ok {
+		return nil, fmt.Errorf("unsupported NIC model '%s'", nic.Model)
+	}
+	if err := validateNICLimits(&nic.Limits); err != nil {
+		return nil, err
+	}
+
+	if nic.MacAddress == "" {
+		nic.MacAddress = generateMACAddress()
+	} else {
+		mac, err := net.ParseMAC(nic.MacAddress)
+		if err != nil {
+			return nil, err
+		}
+		nic.MacAddress = mac.String()
+		// minivmm's DHCP server leases only to the QEMU's vendor prefix
+		if !isBridgedNetwork(nw) && !strings.HasPrefix(nic.MacAddress, vmMACVendor) {
+			return nil, fmt.Errorf("MAC address must start with '%s'", vmMACVendor)
+		}
+		for _, n := range existing {
+			if n.MacAddress == nic.MacAddress {
+				return nil, fmt.Errorf("MAC address '%s' is already used", nic.MacAddress)
+			}
+		}
+		if vm, err := GetVMFromMac(nic.MacAddress); err == nil {
+			return nil, fmt.Errorf("MAC address '%s' is already used by VM '%s'", nic.MacAddress, vm.Name)
+		}
+	}
+
+	nic.ID = nextNICID(existing)
+	nic.IPAddress = ""
+	nic.IPv6Address = ""
+	return &nic, nil
+}
+
+// prepareVMIFScripts generates the scripts which qemu runs to attach/detach the tap interface to the network.
+func prepareVMIFScripts(network string) error {
+	params, err := getVMIFScriptParams(network)
+	if err != nil {
+		return errors.Wrap(err, "VM network not found")
+	}
+	upScript, downScript := getVMIFScriptPaths(network)
+	err = generateVMIFSetupScript(upScript, params)
+	if err != nil {
+		return errors.Wrap(err, "VM interface setup script generate failed")
+	}
+	err = generateVMIFCleanupScript(downScript, params)
+	if err != nil {
+		return errors.Wrap(err, "VM interface cleanup script generate failed")
+	}
+	return nil
+}
+
+// updatePrimaryNIC syncs the VM's addresses with the first NIC.
+func updatePrimaryNIC(metaData *VMMetaData) {
+	if len(metaData.NICs) == 0 {
+		metaData.MacAddress = ""
+		metaData.IPAddress = ""
+		metaData.IPv6Address = ""
+		return
+	}
+	metaData.MacAddress = metaData.NICs[0].MacAddress
+	metaData.IPAddress = metaData.NICs[0].IPAddress
+	metaData.IPv6Address = metaData.NICs[0].IPv6Address
+}
+
+// AddNIC adds a new NIC to the VM. If the VM is running, the NIC is hot-plugged.
+func AddNIC(name string, nic NIC) (ret *VMMetaData, retErr error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "AddNIC: Failed to get VM metadata")
+	}
+	if metaData.Lock {
+		return nil, errors.New("VM is locked")
+	}
+
+	// the user network may be allocated by assignNICNetwork even if a later step fails
+	defer func() {
+		if retErr != nil {
+			if relErr := releaseUserNetwork(metaData.Owner); relErr != nil {
+				log.Println("Ignore releaseUserNetwork error:", relErr)
+			}
+		}
+	}()
+	err = assignNICNetwork(metaData.Owner, &nic)
+	if err != nil {
+		return nil, errors.Wrap(err, "AddNIC")
+	}
+	n, err := prepareNIC(nic, metaData.NICs)
+	if err != nil {
+		return nil, errors.Wrap(err, "AddNIC")
+	}
+	if len(metaData.SecurityGroups) > 0 {
+		err = validateSecurityGroupNICs([]NIC{*n})
+		if err != nil {
+			return nil, errors.Wrap(err, "AddNIC")
+		}
+	}
+
+	if metaData.Status != "stopped" {
+		err = hotAddNIC(name, n)
+		if err != nil {
+			return nil, errors.Wrap(err, "AddNIC: Failed to hot-add NIC")
+		}
+	}
+
+	metaData.NICs = append(metaData.NICs, *n)
+	updatePrimaryNIC(metaData)
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+	if len(metaData.SecurityGroups) > 0 {
+		if err := ApplySecurityGroups(); err != nil {
+			log.Println("Ignore ApplySecurityGroups error:", err)
+		}
+	}
+
+	return metaData, nil
+}
+
+// RemoveNIC removes the NIC from the VM. If the VM is running, the NIC is hot-unplugged.
+func RemoveNIC(name, id string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "RemoveNIC: Failed to get VM metadata")
+	}
+	if metaData.Lock {
+		return nil, errors.New("VM is locked")
+	}
+
+	for i, nic := range metaData.NICs {
+		if nic.ID != id {
+			continue
+		}
+
+		if metaData.Status != "stopped" {
+			err = hotRemoveNIC(name, &nic)
+			if err != nil {
+				return nil, errors.Wrap(err, "RemoveNIC: Failed to hot-remove NIC")
+			}
+		}
+		vmIFName := getVMIFName(name, &nic)
+		if isExistsVMIF(vmIFName) {
+			if err := cleanupVMIF(vmIFName); err != nil {
+				log.Println("Ignore cleanupVMIF error:", err)
+			}
+		}
+
+		oldIP := metaData.IPAddress
+		metaData.NICs = append(metaData.NICs[:i], metaData.NICs[i+1:]...)
+		updatePrimaryNIC(metaData)
+		err = saveVMMetaData(name, metaData)
+		if err != nil {
+			return nil, err
+		}
+		if metaData.IPAddress != oldIP {
+			UpdateIPAddressInForwarder(name, metaData.IPAddress)
+		}
+		if err := ApplySecurityGroups(); err != nil {
+			log.Println("Ignore ApplySecurityGroups error:", err)
+		}
+		if err := releaseUserNetwork(metaData.Owner); err != nil {
+			log.Println("Ignore releaseUserNetwork error:", err)
+		}
+
+		return metaData, nil
+	}
+
+	return nil, fmt.Errorf("Cannot remove '%s'. No such a NIC", id)
+}
+
+func hotAddNIC(name string, nic *NIC) error {
+	nw, err := GetNetwork(nic.Network)
+	if err != nil {
+		return err
+	}
+
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "QMP connection failed")
+	}
+	defer q.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	vmIFName := getVMIFName(name, nic)
+	if nw.Mode == NetworkModeMacvtap {
+		f, err := prepareMacvtap(vmIFName, nw.HostInterface, nic.MacAddress)
+		if err != nil {
+			return errors.Wrap(err, "macvtap setup failed")
+		}
+		defer f.Close()
+
+		err = q.ExecuteGetFD(ctx, nic.ID, f)
+		if err != nil {
+			return errors.Wrap(err, "getfd command failed")
+		}
+		_, err = q.ExecuteRawCommand(ctx, "netdev_add", map[string]interface{}{"type": "tap", "id": nic.ID, "fd": nic.ID}, nil)
+		if err != nil {
+			return errors.Wrap(err, "netdev_add command failed")
+		}
+	} else {
+		prepareVMIF(vmIFName)
+		err = prepareVMIFScripts(nic.Network)
+		if err != nil {
+			return err
+		}
+
+		upScript, downScript := getVMIFScriptPaths(nic.Network)
+		err = q.ExecuteNetdevAdd(ctx, "tap", nic.ID, vmIFName, downScript, upScript, 0)
+		if err != nil {
+			return errors.Wrap(err, "netdev_add command failed")
+		}
+	}
+
+	args := map[string]interface{}{
+		"driver": nic.Model,
+		"id":     getNICDeviceID(nic),
+		"netdev": nic.ID,
+		"mac":    nic.MacAddress,
+	}
+	_, err = q.ExecuteRawCommand(ctx, "device_add", args, nil)
+	if err != nil {
+		q.ExecuteNetdevDel(ctx, nic.ID)
+		return errors.Wrap(err, "device_add command failed")
+	}
+
+	err = applyNICLimits(name, nic)
+	if err != nil {
+		log.Println("Ignore applyNICLimits error:", err)
+	}
+
+	return nil
+}
+
+func hotRemoveNIC(name string, nic *NIC) error {
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "QMP connection failed")
+	}
+	defer q.Shutdown()
+
+	// device_del waits for the guest to release the device
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = q.ExecuteDeviceDel(ctx, getNICDeviceID(nic))
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return errors.Wrap(err, "device_del command failed")
+	}
+	err = q.ExecuteNetdevDel(ctx, nic.ID)
+	if err != nil {
+		return errors.Wrap(err, "netdev_del command failed")
+	}
+
+	return nil
+}
@@ -1,30 +1,92 @@
 package minivmm
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/apparentlymart/go-cidr/cidr"
+	"github.com/pkg/errors"
 )
 
 type vmNetworkInfo struct {
-	cidrIPNet *net.IPNet
-	cidrLen   int
-	gwIP      net.IP
-	startIP   net.IP
+	cidrIPNet  *net.IPNet
+	cidrLen    int
+	gwIP       net.IP
+	startIP    net.IP
+	leaseRange int
+
+	// IPv6 settings are optional. cidr6IPNet is nil if IPv6 is disabled.
+	cidr6IPNet *net.IPNet
+	gw6IP      net.IP
+}
+
+// NetworkMetaData is VM network's settings.
+type NetworkMetaData struct {
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	CIDR      string `json:"cidr"`
+	CIDR6     string `json:"cidr6"`
+	DHCPStart string `json:"dhcp_start"`
+	DHCPEnd   string `json:"dhcp_end"`
+	NAT       bool   `json:"nat"`
+	// Isolated network has no route to the outside, and cannot reach the host services (API, forwards, etc.) either.
+	Isolated bool `json:"isolated"`
+	// Private network is dedicated to the owner and cannot reach other networks.
+	Private bool `json:"private"`
+	// Mode is empty for the network routed by minivmm, or NetworkModeBridge/NetworkModeMacvtap.
+	Mode          string `json:"mode"`
+	HostInterface string `json:"host_interface"`
 }
 
 var (
 	nsName    = "minivmm"
 	brName    = "br-minivmm"
 	vethNames = []string{"minivmm", "minivmm-peer"}
+
+	// DefaultNetworkName is the name of the network configured by environment variables.
+	DefaultNetworkName = "default"
+
+	// interface names are derived from the network name, so its length is limited by IFNAMSIZ.
+	validNetworkName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,10}$`)
+
+	networkStopChannels = make(map[string]chan struct{})
+	networkStopMutex    sync.Mutex
 )
 
-func newNetworkInfo() (*vmNetworkInfo, error) {
-	_, cidrIPNet, err := net.ParseCIDR(C.SubnetCIDR)
+func getDefaultNetwork() *NetworkMetaData {
+	return &NetworkMetaData{
+		Name:  DefaultNetworkName,
+		CIDR:  C.SubnetCIDR,
+		CIDR6: C.SubnetCIDR6,
+		NAT:   true,
+	}
+}
+
+// getNetworkIFNames returns the bridge name in netns and the veth pair names connecting host and the bridge.
+func getNetworkIFNames(nw *NetworkMetaData) (string, []string) {
+	if nw.Name == DefaultNetworkName {
+		return brName, vethNames
+	}
+	return "br-" + nw.Name, []string{"nw-" + nw.Name, "nwp-" + nw.Name}
+}
+
+func newNetworkInfo(nw *NetworkMetaData) (*vmNetworkInfo, error) {
+	_, cidrIPNet, err := net.ParseCIDR(nw.CIDR)
 	if err != nil {
 		return nil, err
 	}
+	if cidrIPNet.IP.To4() == nil {
+		return nil, fmt.Errorf("Subnet '%s' is not an IPv4 subnet", nw.CIDR)
+	}
 	cidrLen, _ := cidrIPNet.Mask.Size()
 	if cidrLen >= 30 {
 		return nil, fmt.Errorf("Subnet size is too small (least '/29')")
@@ -39,55 +101,403 @@ func newNetworkInfo() (*vmNetworkInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	leaseRange := cnt - 3
+
+	if nw.DHCPStart != "" || nw.DHCPEnd != "" {
+		startIP = net.ParseIP(nw.DHCPStart).To4()
+		endIP := net.ParseIP(nw.DHCPEnd).To4()
+		if startIP == nil || endIP == nil {
+			return nil, fmt.Errorf("DHCP range must be specified with both start and end IPv4 addresses")
+		}
+		if !cidrIPNet.Contains(startIP) || !cidrIPNet.Contains(endIP) {
+			return nil, fmt.Errorf("DHCP range is out of the subnet '%s'", nw.CIDR)
+		}
+		leaseRange = int(binary.BigEndian.Uint32(endIP)) - int(binary.BigEndian.Uint32(startIP)) + 1
+		if leaseRange <= 0 {
+			return nil, fmt.Errorf("DHCP range end must be greater than start")
+		}
+		if ipInRange(gwIP, startIP, endIP) {
+			return nil, fmt.Errorf("DHCP range must not contain the gateway address '%s'", gwIP.String())
+		}
+	}
+
+	nwInfo := &vmNetworkInfo{
+		cidrIPNet:  cidrIPNet,
+		cidrLen:    cidrLen,
+		gwIP:       gwIP,
+		startIP:    startIP,
+		leaseRange: leaseRange,
+	}
+
+	if nw.CIDR6 != "" {
+		_, cidr6IPNet, err := net.ParseCIDR(nw.CIDR6)
+		if err != nil {
+			return nil, err
+		}
+		if cidr6IPNet.IP.To4() != nil {
+			return nil, fmt.Errorf("IPv6 subnet '%s' is not an IPv6 prefix", nw.CIDR6)
+		}
+		// SLAAC requires the 64 bits interface identifier
+		if cidr6Len, _ := cidr6IPNet.Mask.Size(); cidr6Len != 64 {
+			return nil, fmt.Errorf("IPv6 subnet prefix length must be '/64'")
+		}
+		gw6IP, err := cidr.Host(cidr6IPNet, 1)
+		if err != nil {
+			return nil, err
+		}
+		nwInfo.cidr6IPNet = cidr6IPNet
+		nwInfo.gw6IP = gw6IP
+	}
 
-	return &vmNetworkInfo{
-		cidrIPNet,
-		cidrLen,
-		gwIP,
-		startIP,
-	}, nil
+	return nwInfo, nil
+}
+
+func ipInRange(ip, start, end net.IP) bool {
+	n := binary.BigEndian.Uint32(ip.To4())
+	return binary.BigEndian.Uint32(start.To4()) <= n && n <= binary.BigEndian.Uint32(end.To4())
 }
 
 // InitNetns initializes netns.
 func InitNetns() error {
-	return Execs([][]string{
+	err := Execs([][]string{
 		{"sudo", "ip", "netns", "add", nsName},
+	})
+	if err != nil {
+		return err
+	}
+	return initNetworkIF(getDefaultNetwork())
+}
 
-		{"sudo", "ip", "link", "add", vethNames[0], "type", "veth", "peer", "name", vethNames[1]},
-		{"sudo", "ip", "link", "set", "netns", nsName, "dev", vethNames[1]},
+func initNetworkIF(nw *NetworkMetaData) error {
+	if isBridgedNetwork(nw) {
+		return nil
+	}
+	br, veths := getNetworkIFNames(nw)
+	return Execs([][]string{
+		{"sudo", "ip", "link", "add", veths[0], "type", "veth", "peer", "name", veths[1]},
+		{"sudo", "ip", "link", "set", "netns", nsName, "dev", veths[1]},
 
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "add", brName, "type", "bridge"},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "master", brName, "dev", vethNames[1]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "add", br, "type", "bridge"},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "master", br, "dev", veths[1]},
 	})
 }
 
-// ResetNetns removes all netns and interfaces.
+// ResetNetns removes all netns, interfaces and NAT rules.
 func ResetNetns() error {
-	return Execs([][]string{
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "down", "dev", vethNames[1]},
-		{"sudo", "ip", "link", "set", "down", "dev", vethNames[0]},
+	removeHostRules()
 
-		{"sudo", "ip", "link", "delete", "dev", vethNames[0]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "delete", brName},
+	nws, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, nw := range nws {
+		if nw.Name == DefaultNetworkName {
+			continue
+		}
+		if err := resetNetworkIF(nw); err != nil {
+			log.Println("Ignore resetNetworkIF error:", err)
+		}
+	}
 
+	err = resetNetworkIF(getDefaultNetwork())
+	if err != nil {
+		return err
+	}
+	return Execs([][]string{
 		{"sudo", "ip", "netns", "delete", nsName},
 	})
 }
 
-// StartNetwork set up interfaces.
+func resetNetworkIF(nw *NetworkMetaData) error {
+	if isBridgedNetwork(nw) {
+		return nil
+	}
+	br, veths := getNetworkIFNames(nw)
+	return Execs([][]string{
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "down", "dev", veths[1]},
+		{"sudo", "ip", "link", "set", "down", "dev", veths[0]},
+
+		{"sudo", "ip", "link", "delete", "dev", veths[0]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "delete", br},
+	})
+}
+
+// StartNetwork set up interfaces, IP forwarding and NAT rules.
 func StartNetwork() error {
-	nwInfo, err := newNetworkInfo()
+	nws, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, nw := range nws {
+		if nw.Name != DefaultNetworkName {
+			// netns is recreated on boot, so the interfaces of the additional networks may be missing
+			initNetworkIF(nw)
+		}
+		if err := startNetworkIF(nw); err != nil {
+			return err
+		}
+	}
+	if err := initOverlay(); err != nil {
+		return errors.Wrap(err, "StartNetwork: overlay setup failed")
+	}
+	return applyHostRules()
+}
+
+func startNetworkIF(nw *NetworkMetaData) error {
+	if isBridgedNetwork(nw) {
+		return nil
+	}
+	nwInfo, err := newNetworkInfo(nw)
 	if err != nil {
 		return err
 	}
 
+	br, veths := getNetworkIFNames(nw)
 	ExecsIgnoreErr([][]string{
-		{"sudo", "ip", "link", "set", "up", "dev", vethNames[0]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", vethNames[1]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "promisc", "on", "dev", vethNames[1]},
-		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", brName},
+		{"sudo", "ip", "link", "set", "up", "dev", veths[0]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", veths[1]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "promisc", "on", "dev", veths[1]},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", br},
 
-		{"sudo", "ip", "addr", "add", fmt.Sprintf("%s/%d", nwInfo.gwIP.String(), nwInfo.cidrLen), "dev", vethNames[0]},
+		{"sudo", "ip", "addr", "add", fmt.Sprintf("%s/%d", nwInfo.gwIP.String(), nwInfo.cidrLen), "dev", veths[0]},
 	})
+	if nwInfo.cidr6IPNet != nil {
+		ExecsIgnoreErr([][]string{
+			{"sudo", "ip", "-6", "addr", "add", fmt.Sprintf("%s/64", nwInfo.gw6IP.String()), "dev", veths[0]},
+		})
+	}
+	return nil
+}
+
+// startNetworkServers starts DHCP and RA servers for the network in the background.
+func startNetworkServers(nw *NetworkMetaData) {
+	if isBridgedNetwork(nw) {
+		// addresses are leased by the DHCP server on the host LAN
+		return
+	}
+	ch := make(chan struct{})
+	networkStopMutex.Lock()
+	networkStopChannels[nw.Name] = ch
+	networkStopMutex.Unlock()
+
+	go func() {
+		if err := serveDHCP(nw, ch); err != nil {
+			log.Printf("[dhcp] WARN dhcp server for network '%s' stopped: %v\n", nw.Name, err)
+		}
+	}()
+	go func() {
+		if err := serveNetworkRA(nw, ch); err != nil {
+			log.Printf("[ra] WARN ra server for network '%s' stopped: %v\n", nw.Name, err)
+		}
+	}()
+}
+
+func stopNetworkServers(name string) {
+	networkStopMutex.Lock()
+	defer networkStopMutex.Unlock()
+
+	ch, ok := networkStopChannels[name]
+	if !ok {
+		return
+	}
+	close(ch)
+	delete(networkStopChannels, name)
+}
+
+func validateNetwork(nw *NetworkMetaData) error {
+	if !validNetworkName.MatchString(nw.Name) {
+		return fmt.Errorf("invalid network name '%s'", nw.Name)
+	}
+	if isBridgedNetwork(nw) {
+		if _, err := GetNetwork(nw.Name); err == nil {
+			return fmt.Errorf("network '%s' already exists", nw.Name)
+		}
+		return validateBridgedNetwork(nw)
+	}
+	if nw.Mode != "" {
+		return fmt.Errorf("unsupported network mode '%s'", nw.Mode)
+	}
+	if nw.Isolated && nw.NAT {
+		return errors.New("isolated network cannot enable NAT")
+	}
+	nwInfo, err := newNetworkInfo(nw)
+	if err != nil {
+		return err
+	}
+
+	nws, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, other := range nws {
+		if other.Name == nw.Name {
+			return fmt.Errorf("network '%s' already exists", nw.Name)
+		}
+		otherInfo, err := newNetworkInfo(other)
+		if err != nil {
+			continue
+		}
+		if isOverlapped(nwInfo.cidrIPNet, otherInfo.cidrIPNet) {
+			return fmt.Errorf("subnet '%s' overlaps with the network '%s'", nw.CIDR, other.Name)
+		}
+		if nwInfo.cidr6IPNet != nil && otherInfo.cidr6IPNet != nil && isOverlapped(nwInfo.cidr6IPNet, otherInfo.cidr6IPNet) {
+			return fmt.Errorf("subnet '%s' overlaps with the network '%s'", nw.CIDR6, other.Name)
+		}
+	}
 	return nil
 }
+
+func isOverlapped(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// CreateNetwork creates a new network and starts its DHCP server.
+func CreateNetwork(nw *NetworkMetaData) error {
+	// the prefix is reserved for user networks not to let users take over others' ones
+	if strings.HasPrefix(nw.Name, userNetworkNamePrefix) {
+		return fmt.Errorf("CreateNetwork: network name must not start with '%s'", userNetworkNamePrefix)
+	}
+	return createNetwork(nw)
+}
+
+func createNetwork(nw *NetworkMetaData) (retErr error) {
+	err := validateNetwork(nw)
+	if err != nil {
+		return errors.Wrap(err, "CreateNetwork")
+	}
+
+	err = writeNetworkFile(nw)
+	if err != nil {
+		return err
+	}
+	// roll back not to leave a half-configured network, whose name cannot be reused
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		if err := resetNetworkIF(nw); err != nil {
+			log.Println("Ignore resetNetworkIF error:", err)
+		}
+		if err := os.Remove(getNetworkFilePath(nw.Name)); err != nil {
+			log.Println("Ignore Remove error:", err)
+		}
+		if err := applyHostRules(); err != nil {
+			log.Println("Ignore applyHostRules error:", err)
+		}
+	}()
+
+	err = initNetworkIF(nw)
+	if err != nil {
+		return err
+	}
+	err = startNetworkIF(nw)
+	if err != nil {
+		return err
+	}
+	err = applyHostRules()
+	if err != nil {
+		return err
+	}
+	startNetworkServers(nw)
+
+	return nil
+}
+
+// RemoveNetwork removes the network which is not used by any VMs.
+func RemoveNetwork(name string) error {
+	if name == DefaultNetworkName {
+		return errors.New("the default network cannot be removed")
+	}
+	nw, err := GetNetwork(name)
+	if err != nil {
+		return errors.Wrap(err, "RemoveNetwork: Failed to get network metadata")
+	}
+
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		for _, nic := range vm.NICs {
+			if nic.Network == name {
+				return fmt.Errorf("network '%s' is used by VM '%s'", name, vm.Name)
+			}
+		}
+	}
+
+	stopNetworkServers(name)
+	err = resetNetworkIF(nw)
+	if err != nil {
+		log.Println("Ignore resetNetworkIF error:", err)
+	}
+
+	err = os.Remove(getNetworkFilePath(name))
+	if err != nil {
+		return err
+	}
+	return applyHostRules()
+}
+
+// GetNetwork returns the network metadata.
+func GetNetwork(name string) (*NetworkMetaData, error) {
+	if name == DefaultNetworkName {
+		return getDefaultNetwork(), nil
+	}
+
+	nw := NetworkMetaData{}
+	b, err := ioutil.ReadFile(getNetworkFilePath(name))
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(b, &nw)
+	return &nw, nil
+}
+
+// ListNetworks returns a list of networks including the default network.
+func ListNetworks() ([]*NetworkMetaData, error) {
+	ret := []*NetworkMetaData{getDefaultNetwork()}
+
+	dirEntries, err := ioutil.ReadDir(C.NetworkDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, errors.Wrap(err, "ListNetworks: Cannot read network data dir")
+	}
+
+	for _, f := range dirEntries {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		nw, err := GetNetwork(f.Name()[:len(f.Name())-len(".json")])
+		if err != nil {
+			log.Println("Ignore GetNetwork error:", err)
+			continue
+		}
+		ret = append(ret, nw)
+	}
+
+	return ret, nil
+}
+
+func getNetworkFilePath(name string) string {
+	return filepath.Join(C.NetworkDir, name+".json")
+}
+
+func writeNetworkFile(nw *NetworkMetaData) error {
+	recordPath := getNetworkFilePath(nw.Name)
+
+	f, err := os.OpenFile(recordPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(nw)
+	if err != nil {
+		return err
+	}
+
+	lockpath := recordPath + ".lock"
+	return WriteWithLock(f, lockpath, b)
+}
@@ -0,0 +1,178 @@
+package minivmm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// every agent uses the same gateway address and MAC address on the overlay network (anycast gateway),
+	// so VMs always reach the internet via their local hypervisor.
+	overlayGatewayMAC = "02:6d:76:6d:00:01"
+	overlayMTU        = 1450
+	vxlanPort         = 4789
+)
+
+var (
+	overlayIFName        = "vx-minivmm"
+	overlayRulesFileName = "overlay-rules.nft"
+)
+
+func overlayEnabled() bool {
+	return C.OverlayVNI != 0
+}
+
+// getOverlayNodes returns the agent names and their API hosts including this hypervisor.
+func getOverlayNodes() map[string]string {
+	nodes := map[string]string{}
+	for _, a := range C.Agents {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		u, err := url.Parse(kv[1])
+		if err != nil {
+			continue
+		}
+		nodes[kv[0]] = u.Hostname()
+	}
+
+	hostname, _ := os.Hostname()
+	if _, ok := nodes[hostname]; !ok {
+		nodes[hostname] = ""
+	}
+	return nodes
+}
+
+// getOverlayNodeIndex returns the position of this hypervisor in the agents sorted by name.
+// All agents must have the same VMM_AGENTS to get consistent indexes.
+func getOverlayNodeIndex() (int, int) {
+	nodes := getOverlayNodes()
+	names := []string{}
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hostname, _ := os.Hostname()
+	return sort.SearchStrings(names, hostname), len(names)
+}
+
+// getOverlayPeers returns the underlay addresses of the other agents.
+func getOverlayPeers() ([]string, error) {
+	hostname, _ := os.Hostname()
+	peers := []string{}
+	for name, host := range getOverlayNodes() {
+		if name == hostname || host == "" {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return nil, errors.Wrapf(err, "cannot resolve agent '%s'", name)
+		}
+		peer := ips[0]
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				peer = ip
+				break
+			}
+		}
+		peers = append(peers, peer.String())
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+// getOverlayLeaseRange splits the DHCP range of the default network by agents
+// so that VMs on different agents never get the same address.
+func getOverlayLeaseRange(start net.IP, leaseRange int) (net.IP, int, error) {
+	idx, cnt := getOverlayNodeIndex()
+	size := leaseRange / cnt
+	if size == 0 {
+		return nil, 0, fmt.Errorf("DHCP range is too small for %d agents", cnt)
+	}
+
+	n := binary.BigEndian.Uint32(start.To4()) + uint32(idx*size)
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip, size, nil
+}
+
+// initOverlay connects the bridge of the default network to the other agents via VXLAN.
+func initOverlay() error {
+	if !overlayEnabled() {
+		return nil
+	}
+	if !useNftables() {
+		return errors.New("overlay network requires nftables")
+	}
+
+	peers, err := getOverlayPeers()
+	if err != nil {
+		return err
+	}
+
+	// recreate the interface to flush the forwarding entries of the old peers
+	ExecsIgnoreErr([][]string{
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "delete", overlayIFName},
+	})
+
+	// the vxlan interface is created in the host netns to send encapsulated packets via host interfaces
+	vxlanCmd := []string{"sudo", "ip", "link", "add", overlayIFName, "type", "vxlan",
+		"id", strconv.Itoa(C.OverlayVNI), "dstport", strconv.Itoa(vxlanPort)}
+	if C.OverlayLocalIP != "" {
+		vxlanCmd = append(vxlanCmd, "local", C.OverlayLocalIP)
+	}
+	cmds := [][]string{
+		vxlanCmd,
+		{"sudo", "ip", "link", "set", "netns", nsName, "dev", overlayIFName},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "mtu", strconv.Itoa(overlayMTU), "dev", overlayIFName},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "master", brName, "dev", overlayIFName},
+		{"sudo", "ip", "link", "set", "address", overlayGatewayMAC, "dev", vethNames[0]},
+	}
+	for _, peer := range peers {
+		cmds = append(cmds, []string{"sudo", "ip", "netns", "exec", nsName, "bridge", "fdb", "append", "00:00:00:00:00:00", "dev", overlayIFName, "dst", peer})
+	}
+	cmds = append(cmds, []string{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "set", "up", "dev", overlayIFName})
+	err = Execs(cmds)
+	if err != nil {
+		return err
+	}
+
+	return applyOverlayRules()
+}
+
+// applyOverlayRules keeps the gateway and DHCP/RA servers local to each agent.
+func applyOverlayRules() error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table bridge %s-overlay\ndelete table bridge %s-overlay\n", nftTableName, nftTableName)
+	fmt.Fprintf(b, "table bridge %s-overlay {\n", nftTableName)
+	fmt.Fprintf(b, "\tchain forward {\n\t\ttype filter hook forward priority -10; policy accept;\n")
+	for _, dir := range []string{"iifname", "oifname"} {
+		fmt.Fprintf(b, "\t\t%s \"%s\" ether saddr %s drop\n", dir, overlayIFName, overlayGatewayMAC)
+		fmt.Fprintf(b, "\t\t%s \"%s\" udp dport { 67, 68 } drop\n", dir, overlayIFName)
+		fmt.Fprintf(b, "\t\t%s \"%s\" icmpv6 type { nd-router-solicit, nd-router-advert } drop\n", dir, overlayIFName)
+	}
+	fmt.Fprintf(b, "\t}\n}\n")
+
+	path := filepath.Join(C.Dir, overlayRulesFileName)
+	err := ioutil.WriteFile(path, []byte(b.String()), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return Execs([][]string{
+		{"sudo", "ip", "netns", "exec", nsName, "nft", "-f", path},
+	})
+}
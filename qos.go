@@ -0,0 +1,164 @@
+package minivmm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// NICLimits is the bandwidth and packet rate limits of the NIC.
+// Ingress is the traffic to the VM and egress is the traffic from the VM.
+// Rates are bits per second with decimal SI prefix (e.g. "100M" is 100,000,000 bit/s), zero or empty means unlimited.
+type NICLimits struct {
+	IngressRate string `json:"ingress_rate"`
+	EgressRate  string `json:"egress_rate"`
+	IngressPPS  int    `json:"ingress_pps"`
+	EgressPPS   int    `json:"egress_pps"`
+}
+
+func (l *NICLimits) isEmpty() bool {
+	return (l.IngressRate == "" || l.IngressRate == "0") && (l.EgressRate == "" || l.EgressRate == "0") &&
+		l.IngressPPS == 0 && l.EgressPPS == 0
+}
+
+// rateMultipliers are decimal unlike convertSIPrefixedValue for memory and disk sizes, as network rates usually are.
+var rateMultipliers = map[string]int{"": 1, "K": 1000, "M": 1000 * 1000, "G": 1000 * 1000 * 1000, "T": 1000 * 1000 * 1000 * 1000}
+
+func parseRate(rate string) (int, error) {
+	if rate == "" {
+		return 0, nil
+	}
+	match := validValue.FindStringSubmatch(rate)
+	if len(match) == 0 || len(match[3]) != 0 {
+		return 0, fmt.Errorf("invalid rate '%s'", rate)
+	}
+	multiplier, ok := rateMultipliers[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate '%s'", rate)
+	}
+	v, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid rate '%s'", rate)
+	}
+	return v * multiplier, nil
+}
+
+func validateNICLimits(l *NICLimits) error {
+	if _, err := parseRate(l.IngressRate); err != nil {
+		return err
+	}
+	if _, err := parseRate(l.EgressRate); err != nil {
+		return err
+	}
+	if l.IngressPPS < 0 || l.EgressPPS < 0 {
+		return errors.New("packet rate must not be negative")
+	}
+	return nil
+}
+
+// generatePoliceActions returns tc actions which drop the packets exceeding the rates.
+func generatePoliceActions(rate string, pps int) []string {
+	bps, _ := parseRate(rate)
+
+	polices := [][]string{}
+	if bps > 0 {
+		// allow 100ms bursts
+		burst := bps / 8 / 10
+		if burst < 15000 {
+			burst = 15000
+		}
+		polices = append(polices, []string{"rate", fmt.Sprintf("%dbit", bps), "burst", strconv.Itoa(burst)})
+	}
+	if pps > 0 {
+		burst := pps / 10
+		if burst < 10 {
+			burst = 10
+		}
+		polices = append(polices, []string{"pkts_rate", strconv.Itoa(pps), "pkts_burst", strconv.Itoa(burst)})
+	}
+
+	args := []string{}
+	for i, p := range polices {
+		// conformed packets are passed to the next action
+		conform := "pipe"
+		if i == len(polices)-1 {
+			conform = "ok"
+		}
+		args = append(args, "action", "police")
+		args = append(args, p...)
+		args = append(args, "conform-exceed", "drop/"+conform)
+	}
+	return args
+}
+
+// getTCCommand returns tc command running in the netns where the tap interface of the network exists.
+func getTCCommand(network string) []string {
+	nw, err := GetNetwork(network)
+	if err == nil && isBridgedNetwork(nw) {
+		return []string{"sudo", "tc"}
+	}
+	return []string{"sudo", "ip", "netns", "exec", nsName, "tc"}
+}
+
+// applyNICLimits replaces the tc filters on the tap interface of the NIC.
+// The egress hook of the tap is the ingress traffic of the VM, and vice versa.
+func applyNICLimits(name string, nic *NIC) error {
+	ifName := getVMIFName(name, nic)
+	tc := getTCCommand(nic.Network)
+
+	ExecsIgnoreErr([][]string{
+		append(tc, "qdisc", "del", "dev", ifName, "clsact"),
+	})
+	if nic.Limits.isEmpty() {
+		return nil
+	}
+
+	cmds := [][]string{
+		append(tc, "qdisc", "add", "dev", ifName, "clsact"),
+	}
+	if actions := generatePoliceActions(nic.Limits.IngressRate, nic.Limits.IngressPPS); len(actions) > 0 {
+		cmd := append(tc, "filter", "add", "dev", ifName, "egress", "matchall")
+		cmds = append(cmds, append(cmd, actions...))
+	}
+	if actions := generatePoliceActions(nic.Limits.EgressRate, nic.Limits.EgressPPS); len(actions) > 0 {
+		cmd := append(tc, "filter", "add", "dev", ifName, "ingress", "matchall")
+		cmds = append(cmds, append(cmd, actions...))
+	}
+	return Execs(cmds)
+}
+
+// SetNICLimits updates the rate limits of the NIC. The limits are applied immediately if the VM is running.
+func SetNICLimits(name, id string, limits NICLimits) (*VMMetaData, error) {
+	err := validateNICLimits(&limits)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetNICLimits")
+	}
+
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetNICLimits: Failed to get VM metadata")
+	}
+
+	for i := range metaData.NICs {
+		nic := &metaData.NICs[i]
+		if nic.ID != id {
+			continue
+		}
+
+		nic.Limits = limits
+		if metaData.Status != "stopped" {
+			err = applyNICLimits(name, nic)
+			if err != nil {
+				return nil, errors.Wrap(err, "SetNICLimits: Failed to apply limits")
+			}
+		}
+		err = saveVMMetaData(name, metaData)
+		if err != nil {
+			return nil, err
+		}
+		return metaData, nil
+	}
+
+	return nil, fmt.Errorf("Cannot update '%s'. No such a NIC", id)
+}
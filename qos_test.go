@@ -0,0 +1,35 @@
+package minivmm
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		rate     string
+		expected int
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1500", 1500},
+		{"10K", 10000},
+		{"100M", 100000000},
+		{"1G", 1000000000},
+	}
+	for _, c := range cases {
+		actual, err := parseRate(c.rate)
+		if err != nil {
+			t.Errorf("failed to parse rate '%s': %v", c.rate, err)
+			continue
+		}
+		if actual != c.expected {
+			t.Errorf("unexpected rate of '%s'; expected:%d actual:%d", c.rate, c.expected, actual)
+		}
+	}
+
+	for _, invalid := range []string{"10Mbps", "1P", "M", "-1"} {
+		if _, err := parseRate(invalid); err == nil {
+			t.Errorf("invalid rate '%s' is parsed", invalid)
+		}
+	}
+}
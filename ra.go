@@ -0,0 +1,290 @@
+package minivmm
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	raInterval          = 200 * time.Second
+	raRouterLifetime    = 1800
+	raValidLifetime     = 86400
+	raPreferredLifetime = 14400
+	raRDNSSLifetime     = 600
+)
+
+// ServeRA sends router advertisements on the default network to make VMs configure their IPv6 address by SLAAC.
+// The additional networks are served by ServeDHCP.
+func ServeRA() {
+	err := serveNetworkRA(getDefaultNetwork(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveNetworkRA serves router advertisements for the network. It does nothing if the IPv6 subnet is not configured.
+func serveNetworkRA(nw *NetworkMetaData, stopChan chan struct{}) error {
+	nwInfo, err := newNetworkInfo(nw)
+	if err != nil {
+		return err
+	}
+	if nwInfo.cidr6IPNet == nil {
+		return nil
+	}
+
+	_, dnsIPs := parseNameServers()
+	_, veths := getNetworkIFNames(nw)
+	return serveRA(veths[0], nwInfo.cidr6IPNet, dnsIPs, stopChan)
+}
+
+func serveRA(ifName string, prefix *net.IPNet, dnsIPs []net.IP, stopChan chan struct{}) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// RA must be sent with hop limit 255 (RFC4861 6.1.2)
+	p := c.IPv6PacketConn()
+	if err := p.SetMulticastInterface(ifi); err != nil {
+		return err
+	}
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.SetHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.JoinGroup(ifi, &net.IPAddr{IP: net.IPv6linklocalallrouters}); err != nil {
+		return err
+	}
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return err
+	}
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := p.SetICMPFilter(&f); err != nil {
+		return err
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Code: 0,
+		Body: &icmp.RawBody{Data: buildRouterAdvertisement(prefix, ifi.HardwareAddr, dnsIPs)},
+	}
+	// the checksum is calculated by kernel for ICMPv6 raw sockets
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	dst := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: ifName}
+	advertise := func() {
+		if _, err := p.WriteTo(b, nil, dst); err != nil {
+			log.Println("[ra] WARN failed to send router advertisement:", err)
+		}
+	}
+
+	// reply solicitations in the background
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, cm, _, err := p.ReadFrom(buf)
+			if err != nil {
+				// the connection is closed when stopped
+				return
+			}
+			if cm != nil && cm.IfIndex != ifi.Index {
+				continue
+			}
+			advertise()
+		}
+	}()
+
+	log.Printf("[ra] INFO start advertising %s on %s\n", prefix.String(), ifName)
+	ticker := time.NewTicker(raInterval)
+	defer ticker.Stop()
+	for {
+		advertise()
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			log.Printf("[ra] INFO stop advertising on %s\n", ifName)
+			return nil
+		}
+	}
+}
+
+// buildRouterAdvertisement returns the router advertisement message body following the ICMP header (RFC4861 4.2).
+func buildRouterAdvertisement(prefix *net.IPNet, mac net.HardwareAddr, dnsIPs []net.IP) []byte {
+	b := make([]byte, 12)
+	b[0] = 64 // cur hop limit
+	b[1] = 0  // M and O flags are off, addresses are configured by SLAAC only
+	binary.BigEndian.PutUint16(b[2:4], raRouterLifetime)
+
+	// prefix information option
+	prefixLen, _ := prefix.Mask.Size()
+	opt := make([]byte, 32)
+	opt[0] = 3
+	opt[1] = 4
+	opt[2] = byte(prefixLen)
+	opt[3] = 0xc0 // on-link and autonomous address-configuration flags
+	binary.BigEndian.PutUint32(opt[4:8], raValidLifetime)
+	binary.BigEndian.PutUint32(opt[8:12], raPreferredLifetime)
+	copy(opt[16:32], prefix.IP.To16())
+	b = append(b, opt...)
+
+	// source link-layer address option
+	if len(mac) == 6 {
+		opt = []byte{1, 1}
+		opt = append(opt, mac...)
+		b = append(b, opt...)
+	}
+
+	// recursive DNS server option (RFC8106)
+	if len(dnsIPs) > 0 {
+		opt = make([]byte, 8)
+		opt[0] = 25
+		opt[1] = byte(1 + 2*len(dnsIPs))
+		binary.BigEndian.PutUint32(opt[4:8], raRDNSSLifetime)
+		for _, ip := range dnsIPs {
+			opt = append(opt, ip.To16()...)
+		}
+		b = append(b, opt...)
+	}
+
+	return b
+}
+
+// getVMIPv6Address returns the IPv6 address of the VM's NIC. It returns empty if IPv6 is disabled on the network
+// or no address has been observed yet.
+// Guests may not use the EUI-64 address (e.g. RFC 7217 stable privacy or temporary addresses),
+// so the address is looked up in the neighbor table and asked to the guest agent instead of being guessed.
+// current is kept as long as it's still used not to change the address of forwards and DNS frequently.
+func getVMIPv6Address(vmName, network, macAddr, current string) string {
+	nw, err := GetNetwork(network)
+	if err != nil {
+		return ""
+	}
+	nwInfo, err := newNetworkInfo(nw)
+	if err != nil || nwInfo.cidr6IPNet == nil {
+		return ""
+	}
+
+	var candidates []net.IP
+	_, veths := getNetworkIFNames(nw)
+	out, err := ExecsStdout([][]string{
+		{"ip", "-6", "neigh", "show", "dev", veths[0]},
+	})
+	if err == nil {
+		candidates = append(candidates, parseNeighborIPv6s(out[0], macAddr)...)
+	}
+	guestIFs, err := getGuestInterfaces(vmName)
+	if err == nil {
+		candidates = append(candidates, findGuestIPv6s(guestIFs, macAddr)...)
+	}
+	return selectIPv6Address(candidates, nwInfo.cidr6IPNet, current)
+}
+
+// parseNeighborIPv6s returns the IPv6 addresses of the MAC address in the output of `ip -6 neigh show dev <if>`
+// (e.g. "2001:db8::1234 lladdr 52:54:00:12:34:56 REACHABLE").
+func parseNeighborIPv6s(out, macAddr string) []net.IP {
+	var ret []net.IP
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			continue
+		}
+		state := f[len(f)-1]
+		if state == "FAILED" || state == "INCOMPLETE" {
+			continue
+		}
+		ip := net.ParseIP(f[0])
+		if ip == nil || ip.To4() != nil {
+			continue
+		}
+		for i := range f[:len(f)-1] {
+			if f[i] == "lladdr" && strings.EqualFold(f[i+1], macAddr) {
+				ret = append(ret, ip)
+			}
+		}
+	}
+	return ret
+}
+
+func findGuestIPv6s(ifs []guestInterface, macAddr string) []net.IP {
+	var ret []net.IP
+	for _, i := range ifs {
+		if !strings.EqualFold(i.HardwareAddress, macAddr) {
+			continue
+		}
+		for _, a := range i.IPAddresses {
+			ip := net.ParseIP(a.Address)
+			if a.Type == "ipv6" && ip != nil {
+				ret = append(ret, ip)
+			}
+		}
+	}
+	return ret
+}
+
+// selectIPv6Address returns the current address if it's still in candidates, otherwise the first global one in the prefix.
+func selectIPv6Address(candidates []net.IP, prefix *net.IPNet, current string) string {
+	selected := ""
+	for _, ip := range candidates {
+		if !ip.IsGlobalUnicast() || !prefix.Contains(ip) {
+			continue
+		}
+		if ip.String() == current {
+			return current
+		}
+		if selected == "" {
+			selected = ip.String()
+		}
+	}
+	return selected
+}
+
+// WatchIPv6Address updates the IPv6 addresses of VMs on the networks served by minivmm,
+// which are configured by the guests themselves after the DHCP lease.
+func WatchIPv6Address() {
+	for {
+		time.Sleep(neighborPollInterval)
+
+		vms, err := ListVMs()
+		if err != nil {
+			log.Println("Ignore ListVMs error:", err)
+			continue
+		}
+		for _, vm := range vms {
+			if vm.Status == "stopped" {
+				continue
+			}
+			for _, nic := range vm.NICs {
+				if nic.IPAddress == "" {
+					continue
+				}
+				nw, err := GetNetwork(nic.Network)
+				if err != nil || isBridgedNetwork(nw) {
+					continue
+				}
+				addr := getVMIPv6Address(vm.Name, nic.Network, nic.MacAddress, nic.IPv6Address)
+				if addr == "" || addr == nic.IPv6Address {
+					continue
+				}
+				VMIPAddressUpdateChan <- &VMMetaData{MacAddress: nic.MacAddress, IPAddress: nic.IPAddress, IPv6Address: addr}
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package minivmm
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSelectVMIPv6Address(t *testing.T) {
+	out := `fe80::1 lladdr 52:54:00:12:34:56 STALE
+2001:db8::aaaa lladdr 52:54:00:12:34:56 REACHABLE
+2001:db8::bbbb lladdr 52:54:00:12:34:56 STALE
+2001:db8::cccc lladdr 52:54:00:ab:cd:ef REACHABLE
+2001:db8::dddd  FAILED
+`
+	candidates := parseNeighborIPv6s(out, "52:54:00:12:34:56")
+	if len(candidates) != 3 {
+		t.Fatalf("unexpected candidates: %v", candidates)
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+	_, otherPrefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	cases := []struct {
+		prefix   *net.IPNet
+		current  string
+		expected string
+	}{
+		{prefix, "", "2001:db8::aaaa"},
+		{prefix, "2001:db8::bbbb", "2001:db8::bbbb"},
+		{prefix, "2001:db8::eeee", "2001:db8::aaaa"},
+		{otherPrefix, "", ""},
+	}
+	for _, c := range cases {
+		actual := selectIPv6Address(candidates, c.prefix, c.current)
+		if actual != c.expected {
+			t.Errorf("unexpected address of current:%s; expected:%s actual:%s", c.current, c.expected, actual)
+		}
+	}
+}
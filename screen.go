@@ -0,0 +1,206 @@
+package minivmm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const screenshotFilePattern = "screenshot-*.ppm"
+
+// qKeyCodes is the key names accepted by QEMU's send-key command (QKeyCode).
+var qKeyCodes = map[string]bool{}
+
+func init() {
+	names := `unmapped shift shift_r alt alt_r ctrl ctrl_r menu esc
+		1 2 3 4 5 6 7 8 9 0 minus equal backspace tab
+		q w e r t y u i o p bracket_left bracket_right ret
+		a s d f g h j k l semicolon apostrophe grave_accent backslash
+		z x c v b n m comma dot slash asterisk spc caps_lock
+		f1 f2 f3 f4 f5 f6 f7 f8 f9 f10 f11 f12 f13 f14 f15 f16 f17 f18 f19 f20 f21 f22 f23 f24
+		num_lock scroll_lock kp_divide kp_multiply kp_subtract kp_add kp_enter kp_decimal sysrq
+		kp_0 kp_1 kp_2 kp_3 kp_4 kp_5 kp_6 kp_7 kp_8 kp_9 kp_comma kp_equals
+		less home pgup pgdn end left up down right insert delete
+		stop again props undo front copy open paste find cut lf help meta_l meta_r compose pause
+		ro hiragana henkan yen muhenkan katakanahiragana lang1 lang2
+		power sleep wake audionext audioprev audiostop audioplay audiomute volumeup volumedown
+		mediaselect mail calculator computer ac_home ac_back ac_forward ac_refresh ac_bookmarks`
+	for _, name := range strings.Fields(names) {
+		qKeyCodes[name] = true
+	}
+}
+
+// readPPMHeaderValue reads a whitespace separated value of PPM header skipping comments.
+func readPPMHeaderValue(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '#' && len(buf) == 0:
+			_, err := r.ReadBytes('\n')
+			if err != nil {
+				return "", err
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			// a single whitespace follows the last value before the raster
+			if len(buf) > 0 {
+				return string(buf), nil
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+}
+
+// decodePPM decodes a binary PPM (P6) image, which is the format of qemu's screendump.
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var values []int
+	magic, err := readPPMHeaderValue(br)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported PPM format '%s'", magic)
+	}
+	for i := 0; i < 3; i++ {
+		s, err := readPPMHeaderValue(br)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid PPM header value '%s'", s)
+		}
+		values = append(values, v)
+	}
+	width, height, maxVal := values[0], values[1], values[2]
+	if maxVal > 255 {
+		return nil, fmt.Errorf("unsupported PPM max value %d", maxVal)
+	}
+
+	raster := make([]byte, width*height*3)
+	_, err = io.ReadFull(br, raster)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := raster[(y*width+x)*3:]
+			img.Set(x, y, color.RGBA{
+				R: uint8(int(p[0]) * 255 / maxVal),
+				G: uint8(int(p[1]) * 255 / maxVal),
+				B: uint8(int(p[2]) * 255 / maxVal),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+// GetScreenshot returns the screen of the specified VM as a PNG image.
+func GetScreenshot(name string) ([]byte, error) {
+	if _, err := loadVMMetaData(name); err != nil {
+		return nil, errors.Wrap(err, "GetScreenshot: Failed to get VM metadata")
+	}
+
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "GetScreenshot: QMP connection failed")
+	}
+	defer q.Shutdown()
+
+	// qemu writes the screen into a file, which is unique to each request not to be mixed up with concurrent ones
+	tmp, err := ioutil.TempFile(filepath.Join(C.VMDir, name), screenshotFilePattern)
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	path := tmp.Name()
+	defer os.Remove(path)
+	_, err = q.ExecuteRawCommand(context.Background(), "screendump", map[string]interface{}{"filename": path}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetScreenshot: screendump command failed")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := decodePPM(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetScreenshot: Failed to decode screendump")
+	}
+
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetScreenshot: Failed to encode PNG")
+	}
+	return buf.Bytes(), nil
+}
+
+// ValidateKeys checks the keys are specified and all of them are QEMU's QKeyCode.
+func ValidateKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys are specified")
+	}
+	for _, k := range keys {
+		if !qKeyCodes[k] {
+			return fmt.Errorf("unknown key '%s'", k)
+		}
+	}
+	return nil
+}
+
+// SendKeys presses the keys simultaneously on the specified VM, like ["ctrl", "alt", "delete"].
+// The key names are QEMU's QKeyCode. holdTime is the duration in milliseconds, the default is used if 0.
+func SendKeys(name string, keys []string, holdTime int) error {
+	if _, err := loadVMMetaData(name); err != nil {
+		return errors.Wrap(err, "SendKeys: Failed to get VM metadata")
+	}
+	err := ValidateKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "SendKeys: QMP connection failed")
+	}
+	defer q.Shutdown()
+
+	keyValues := []map[string]interface{}{}
+	for _, k := range keys {
+		keyValues = append(keyValues, map[string]interface{}{"type": "qcode", "data": k})
+	}
+	args := map[string]interface{}{"keys": keyValues}
+	if holdTime > 0 {
+		args["hold-time"] = holdTime
+	}
+	_, err = q.ExecuteRawCommand(context.Background(), "send-key", args, nil)
+	if err != nil {
+		return errors.Wrap(err, "SendKeys: send-key command failed")
+	}
+
+	return nil
+}
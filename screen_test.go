@@ -0,0 +1,61 @@
+package minivmm
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePPM(t *testing.T) {
+	ppm := append([]byte("P6\n# comment\n2 1\n255\n"), 255, 0, 0, 0, 128, 255)
+	img, err := decodePPM(bytes.NewReader(ppm))
+	if err != nil {
+		t.Fatalf("failed to decode PPM: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("unexpected image size: %v", b)
+	}
+	expected := []color.RGBA{{255, 0, 0, 255}, {0, 128, 255, 255}}
+	for x, e := range expected {
+		if c := color.RGBAModel.Convert(img.At(x, 0)).(color.RGBA); c != e {
+			t.Errorf("unexpected pixel at %d; expected:%v actual:%v", x, e, c)
+		}
+	}
+
+	invalids := [][]byte{
+		[]byte("P3\n2 1\n255\n0 0 0 0 0 0\n"),
+		[]byte("P6\n2 x\n255\n"),
+		append([]byte("P6\n2 1\n255\n"), 0, 0, 0),
+	}
+	for _, invalid := range invalids {
+		if _, err := decodePPM(bytes.NewReader(invalid)); err == nil {
+			t.Errorf("invalid PPM is decoded: %q", invalid)
+		}
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	valids := [][]string{
+		{"ctrl", "alt", "delete"},
+		{"a"},
+		{"kp_enter"},
+	}
+	for _, keys := range valids {
+		if err := ValidateKeys(keys); err != nil {
+			t.Errorf("valid keys are rejected: %v: %v", keys, err)
+		}
+	}
+
+	invalids := [][]string{
+		nil,
+		{},
+		{"ctrl", "Alt"},
+		{"control"},
+		{""},
+	}
+	for _, keys := range invalids {
+		if err := ValidateKeys(keys); err == nil {
+			t.Errorf("invalid keys are accepted: %v", keys)
+		}
+	}
+}
@@ -53,8 +53,17 @@ fi
 
 # Setup service user
 grep -q $USR /etc/passwd || $sudo useradd $USR -b $(dirname $VMM_DIR)
-echo "Defaults:$USR !requiretty" | $sudo tee /etc/sudoers.d/$USR > /dev/null
-echo "$USR ALL=(ALL) NOPASSWD:/sbin/ip" | $sudo tee /etc/sudoers.d/$USR > /dev/null
+sudo_cmds=/sbin/ip
+for c in sysctl iptables ip6tables nft chown tc; do
+  p=$(PATH=$PATH:/sbin:/usr/sbin command -v $c || true)
+  if [ -n "$p" ]; then
+    sudo_cmds="$sudo_cmds,$p"
+  fi
+done
+cat << EOS | $sudo tee /etc/sudoers.d/$USR > /dev/null
+Defaults:$USR !requiretty
+$USR ALL=(ALL) NOPASSWD:$sudo_cmds
+EOS
 $sudo chmod 440 /etc/sudoers.d/$USR
 
 # Setup data directory
@@ -93,5 +102,3 @@ EOS
 $sudo systemctl enable minivmm.service
 $sudo systemctl start minivmm.service
 
-default_dev=$(ip route | grep "^default" | sed -e 's|.*\(dev.*\)|\1|' | awk '{print $2}')
-$sudo iptables -t nat -A POSTROUTING -o $default_dev -s ${VMM_SUBNET_CIDR} -j MASQUERADE
@@ -0,0 +1,422 @@
+package minivmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	secGroupRulesFilePattern = "secgroup-rules-*.nft"
+	// secGroupRulesMutex serializes ApplySecurityGroups not to load a stale ruleset over the latest one.
+	secGroupRulesMutex sync.Mutex
+	validSecGroupName  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// SecurityGroupMetaData is a set of firewall rules attachable to VMs.
+// Once a security group is attached, the VM accepts only the ingress traffic allowed by the rules.
+// Egress traffic is restricted only if any egress rules exist.
+type SecurityGroupMetaData struct {
+	Name        string              `json:"name"`
+	Owner       string              `json:"owner"`
+	Description string              `json:"description"`
+	Rules       []SecurityGroupRule `json:"rules"`
+}
+
+// SecurityGroupRule is an allow rule of the security group.
+// The remote peer is specified by one of CIDR, RemoteVM or RemoteTag, any peers are allowed if none of them is set.
+type SecurityGroupRule struct {
+	Direction string `json:"direction"`
+	Protocol  string `json:"protocol"`
+	PortMin   int    `json:"port_min"`
+	PortMax   int    `json:"port_max"`
+	CIDR      string `json:"cidr"`
+	RemoteVM  string `json:"remote_vm"`
+	RemoteTag string `json:"remote_tag"`
+}
+
+func validateSecurityGroup(sg *SecurityGroupMetaData) error {
+	if !validSecGroupName.MatchString(sg.Name) {
+		return fmt.Errorf("invalid security group name '%s'", sg.Name)
+	}
+	for _, r := range sg.Rules {
+		if r.Direction != "ingress" && r.Direction != "egress" {
+			return fmt.Errorf("invalid direction '%s'", r.Direction)
+		}
+		switch r.Protocol {
+		case "", "icmp":
+			if r.PortMin != 0 || r.PortMax != 0 {
+				return fmt.Errorf("port range requires tcp or udp protocol")
+			}
+		case "tcp", "udp":
+			if r.PortMin < 0 || r.PortMax > 65535 || r.PortMin > r.PortMax {
+				return fmt.Errorf("invalid port range %d-%d", r.PortMin, r.PortMax)
+			}
+		default:
+			return fmt.Errorf("invalid protocol '%s'", r.Protocol)
+		}
+		if r.CIDR != "" {
+			if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateSecurityGroup creates a new security group.
+func CreateSecurityGroup(sg *SecurityGroupMetaData) error {
+	err := validateSecurityGroup(sg)
+	if err != nil {
+		return errors.Wrap(err, "CreateSecurityGroup")
+	}
+	if exists(getSecurityGroupFilePath(sg.Name)) {
+		return errors.Errorf("CreateSecurityGroup: security group '%s' already exists", sg.Name)
+	}
+	return writeSecurityGroupFile(sg)
+}
+
+// UpdateSecurityGroup replaces the description and rules of the security group, and applies them to VMs.
+func UpdateSecurityGroup(sg *SecurityGroupMetaData) error {
+	err := validateSecurityGroup(sg)
+	if err != nil {
+		return errors.Wrap(err, "UpdateSecurityGroup")
+	}
+	err = writeSecurityGroupFile(sg)
+	if err != nil {
+		return err
+	}
+	return ApplySecurityGroups()
+}
+
+// RemoveSecurityGroup removes the security group which is not attached to any VMs.
+func RemoveSecurityGroup(name string) error {
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		for _, g := range vm.SecurityGroups {
+			if g == name {
+				return fmt.Errorf("security group '%s' is attached to VM '%s'", name, vm.Name)
+			}
+		}
+	}
+	return os.Remove(getSecurityGroupFilePath(name))
+}
+
+// GetSecurityGroup returns the security group.
+func GetSecurityGroup(name string) (*SecurityGroupMetaData, error) {
+	sg := SecurityGroupMetaData{}
+	b, err := ioutil.ReadFile(getSecurityGroupFilePath(name))
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(b, &sg)
+	return &sg, nil
+}
+
+// ListSecurityGroups returns a list of security groups.
+func ListSecurityGroups() ([]*SecurityGroupMetaData, error) {
+	dirEntries, err := ioutil.ReadDir(C.SecurityGroupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "ListSecurityGroups: Cannot read security group data dir")
+	}
+
+	var ret []*SecurityGroupMetaData
+	for _, f := range dirEntries {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		sg, err := GetSecurityGroup(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			log.Println("Ignore GetSecurityGroup error:", err)
+			continue
+		}
+		ret = append(ret, sg)
+	}
+	return ret, nil
+}
+
+// validateVMSecurityGroups checks the security groups exist and are owned by the VM owner.
+func validateVMSecurityGroups(owner string, groups []string) error {
+	for _, g := range groups {
+		sg, err := GetSecurityGroup(g)
+		if err != nil {
+			return errors.Errorf("security group '%s' does not exist", g)
+		}
+		if sg.Owner != owner {
+			return errors.Errorf("security group '%s' is not owned by the VM owner", g)
+		}
+	}
+	return nil
+}
+
+// validateSecurityGroupNICs checks the NICs can be filtered by security groups.
+// The rules are loaded into the bridge in netns, so NICs on bridged networks in the root netns cannot be filtered.
+func validateSecurityGroupNICs(nics []NIC) error {
+	for _, nic := range nics {
+		nw, err := GetNetwork(nic.Network)
+		if err != nil {
+			return err
+		}
+		if isBridgedNetwork(nw) {
+			return errors.Errorf("security groups are not supported on '%s' mode network '%s'", nw.Mode, nw.Name)
+		}
+	}
+	return nil
+}
+
+// SetVMSecurityGroups replaces the security groups attached to the VM.
+func SetVMSecurityGroups(name string, groups []string) (*VMMetaData, error) {
+	metaData, err := GetVM(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMSecurityGroups: Failed to get VM metadata")
+	}
+
+	err = validateVMSecurityGroups(metaData.Owner, groups)
+	if err != nil {
+		return nil, errors.Wrap(err, "SetVMSecurityGroups")
+	}
+	if len(groups) > 0 {
+		err = validateSecurityGroupNICs(metaData.NICs)
+		if err != nil {
+			return nil, errors.Wrap(err, "SetVMSecurityGroups")
+		}
+	}
+
+	metaData.SecurityGroups = groups
+	err = saveVMMetaData(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ApplySecurityGroups()
+	if err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+func getSecurityGroupFilePath(name string) string {
+	return filepath.Join(C.SecurityGroupDir, name+".json")
+}
+
+func writeSecurityGroupFile(sg *SecurityGroupMetaData) error {
+	recordPath := getSecurityGroupFilePath(sg.Name)
+
+	f, err := os.OpenFile(recordPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(sg)
+	if err != nil {
+		return err
+	}
+
+	lockpath := recordPath + ".lock"
+	return WriteWithLock(f, lockpath, b)
+}
+
+// ApplySecurityGroups regenerates the bridge firewall rules in netns from all VMs and security groups.
+// The rules match the VMs' tap interfaces by name, so stopped VMs are also configured.
+func ApplySecurityGroups() error {
+	secGroupRulesMutex.Lock()
+	defer secGroupRulesMutex.Unlock()
+
+	sgs, err := ListSecurityGroups()
+	if err != nil {
+		return err
+	}
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+
+	if !useNftables() {
+		if securityGroupsUsed(vms) {
+			return errors.New("nftables is required to enforce security groups")
+		}
+		return nil
+	}
+
+	path, err := writeNftRulesFile(secGroupRulesFilePattern, renderSecurityGroupRules(vms, sgs))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return Execs([][]string{
+		{"sudo", "ip", "netns", "exec", nsName, "nft", "-f", path},
+	})
+}
+
+// securityGroupsUsed returns whether any of the VMs has security groups.
+func securityGroupsUsed(vms []*VMMetaData) bool {
+	for _, vm := range vms {
+		if len(vm.SecurityGroups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func renderSecurityGroupRules(vms []*VMMetaData, sgs []*SecurityGroupMetaData) string {
+	sgMap := map[string]*SecurityGroupMetaData{}
+	for _, sg := range sgs {
+		sgMap[sg.Name] = sg
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table bridge %s\ndelete table bridge %s\n", nftTableName, nftTableName)
+	fmt.Fprintf(b, "table bridge %s {\n", nftTableName)
+
+	jumps := []string{}
+	chains := &strings.Builder{}
+	for _, vm := range vms {
+		if len(vm.SecurityGroups) == 0 {
+			continue
+		}
+
+		ingress, egress := []string{}, []string{}
+		for _, g := range vm.SecurityGroups {
+			sg, ok := sgMap[g]
+			if !ok {
+				log.Printf("Ignore missing security group '%s' attached to VM '%s'\n", g, vm.Name)
+				continue
+			}
+			for _, r := range sg.Rules {
+				rules := renderSecurityGroupRule(&r, sg.Owner, vms)
+				if r.Direction == "ingress" {
+					ingress = append(ingress, rules...)
+				} else {
+					egress = append(egress, rules...)
+				}
+			}
+		}
+
+		for i := range vm.NICs {
+			ifName := getVMIFName(vm.Name, &vm.NICs[i])
+			jumps = append(jumps, fmt.Sprintf("\t\toifname \"%s\" jump \"in-%s\"\n", ifName, ifName))
+			jumps = append(jumps, fmt.Sprintf("\t\tiifname \"%s\" jump \"out-%s\"\n", ifName, ifName))
+
+			// ARP, neighbor discovery, DHCP and replies of allowed connections are always accepted
+			// DHCP replies don't match the conntrack entry of the broadcast request
+			fmt.Fprintf(chains, "\tchain \"in-%s\" {\n", ifName)
+			fmt.Fprintf(chains, "\t\tct state established,related accept\n\t\tether type arp accept\n\t\tmeta l4proto ipv6-icmp accept\n")
+			fmt.Fprintf(chains, "\t\tudp sport 67 udp dport 68 accept\n")
+			for _, rule := range ingress {
+				fmt.Fprintf(chains, "\t\t%s accept\n", rule)
+			}
+			fmt.Fprintf(chains, "\t\tdrop\n\t}\n")
+
+			fmt.Fprintf(chains, "\tchain \"out-%s\" {\n", ifName)
+			if len(egress) > 0 {
+				fmt.Fprintf(chains, "\t\tct state established,related accept\n\t\tether type arp accept\n\t\tmeta l4proto ipv6-icmp accept\n")
+				fmt.Fprintf(chains, "\t\tudp sport 68 udp dport 67 accept\n")
+				for _, rule := range egress {
+					fmt.Fprintf(chains, "\t\t%s accept\n", rule)
+				}
+				fmt.Fprintf(chains, "\t\tdrop\n")
+			}
+			fmt.Fprintf(chains, "\t}\n")
+		}
+	}
+
+	fmt.Fprintf(b, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n")
+	for _, j := range jumps {
+		b.WriteString(j)
+	}
+	fmt.Fprintf(b, "\t}\n")
+	b.WriteString(chains.String())
+	fmt.Fprintf(b, "}\n")
+
+	return b.String()
+}
+
+// renderSecurityGroupRule returns the nft match expressions of the rule.
+// Remote VMs are resolved to their addresses, so a rule may be rendered into one expression per address family.
+func renderSecurityGroupRule(r *SecurityGroupRule, owner string, vms []*VMMetaData) []string {
+	addrKey := "saddr"
+	if r.Direction == "egress" {
+		addrKey = "daddr"
+	}
+
+	addrExprs := []string{}
+	if r.CIDR != "" {
+		family := "ip"
+		if ip, _, _ := net.ParseCIDR(r.CIDR); ip.To4() == nil {
+			family = "ip6"
+		}
+		addrExprs = append(addrExprs, fmt.Sprintf("%s %s %s ", family, addrKey, r.CIDR))
+	} else if r.RemoteVM != "" || r.RemoteTag != "" {
+		addrs, addrs6 := []string{}, []string{}
+		for _, vm := range vms {
+			if vm.Owner != owner {
+				continue
+			}
+			if (r.RemoteVM != "" && vm.Name != r.RemoteVM) || (r.RemoteTag != "" && vm.Tag != r.RemoteTag) {
+				continue
+			}
+			for _, nic := range vm.NICs {
+				if nic.IPAddress != "" {
+					addrs = append(addrs, nic.IPAddress)
+				}
+				if nic.IPv6Address != "" {
+					addrs6 = append(addrs6, nic.IPv6Address)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			sort.Strings(addrs)
+			addrExprs = append(addrExprs, fmt.Sprintf("ip %s { %s } ", addrKey, strings.Join(addrs, ", ")))
+		}
+		if len(addrs6) > 0 {
+			sort.Strings(addrs6)
+			addrExprs = append(addrExprs, fmt.Sprintf("ip6 %s { %s } ", addrKey, strings.Join(addrs6, ", ")))
+		}
+		if len(addrExprs) == 0 {
+			return nil
+		}
+	} else {
+		addrExprs = append(addrExprs, "")
+	}
+
+	protoExpr := ""
+	switch r.Protocol {
+	case "tcp", "udp":
+		if r.PortMin == 0 && r.PortMax == 0 {
+			protoExpr = fmt.Sprintf("meta l4proto %s", r.Protocol)
+		} else {
+			protoExpr = fmt.Sprintf("%s dport %d-%d", r.Protocol, r.PortMin, r.PortMax)
+		}
+	case "icmp":
+		protoExpr = "meta l4proto { icmp, ipv6-icmp }"
+	}
+
+	exprs := []string{}
+	for _, a := range addrExprs {
+		if a == "" && protoExpr == "" {
+			// any IPv4/IPv6 traffic
+			exprs = append(exprs, "ether type { ip, ip6 }")
+			continue
+		}
+		exprs = append(exprs, strings.TrimSpace(a+protoExpr))
+	}
+	return exprs
+}
@@ -0,0 +1,49 @@
+package minivmm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderSecurityGroupRules(t *testing.T) {
+	vms := []*VMMetaData{
+		{
+			Name:           "vm1",
+			Owner:          "user1",
+			SecurityGroups: []string{"web"},
+			NICs:           []NIC{{ID: "net0", Network: DefaultNetworkName, MacAddress: "52:54:00:12:34:56", IPAddress: "192.168.200.10"}},
+		},
+		{
+			Name:  "vm2",
+			Owner: "user1",
+			NICs:  []NIC{{ID: "net0", Network: DefaultNetworkName, MacAddress: "52:54:00:12:34:57", IPAddress: "192.168.200.11"}},
+		},
+	}
+	sgs := []*SecurityGroupMetaData{
+		{
+			Name:  "web",
+			Owner: "user1",
+			Rules: []SecurityGroupRule{
+				{Direction: "ingress", Protocol: "tcp", PortMin: 80, PortMax: 80},
+				{Direction: "ingress", Protocol: "tcp", PortMin: 22, PortMax: 22, RemoteVM: "vm2"},
+			},
+		},
+	}
+	rules := renderSecurityGroupRules(vms, sgs)
+
+	ifName := getVMIFName("vm1", &vms[0].NICs[0])
+	expected := "\tchain \"in-" + ifName + "\" {\n" +
+		"\t\tct state established,related accept\n\t\tether type arp accept\n\t\tmeta l4proto ipv6-icmp accept\n" +
+		"\t\tudp sport 67 udp dport 68 accept\n" +
+		"\t\ttcp dport 80-80 accept\n" +
+		"\t\tip saddr { 192.168.200.11 } tcp dport 22-22 accept\n" +
+		"\t\tdrop\n\t}\n"
+	if !strings.Contains(rules, expected) {
+		t.Errorf("rules do not contain %q:\n%s", expected, rules)
+	}
+
+	vm2IFName := getVMIFName("vm2", &vms[1].NICs[0])
+	if strings.Contains(rules, vm2IFName) {
+		t.Errorf("rules contain the VM without security groups:\n%s", rules)
+	}
+}
@@ -0,0 +1,209 @@
+package minivmm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshBastionDialTimeout = 10 * time.Second
+	sshBastionOwnerKey    = "owner"
+)
+
+// sshBastion is the SSH server which only relays direct-tcpip channels (`ssh -J`) to the VMs owned by the user.
+type sshBastion struct {
+	config *ssh.ServerConfig
+	// resolveVM returns the IP address of the VM if it's owned by the user.
+	resolveVM func(owner, name string) (string, error)
+}
+
+// directTCPIPRequest is the payload of direct-tcpip channel request (RFC 4254 7.2).
+type directTCPIPRequest struct {
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+func newSSHBastion(hostKey ssh.Signer, authorize func(ssh.PublicKey) (string, error), resolveVM func(owner, name string) (string, error)) *sshBastion {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			owner, err := authorize(key)
+			if err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{Extensions: map[string]string{sshBastionOwnerKey: owner}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	return &sshBastion{config: config, resolveVM: resolveVM}
+}
+
+// authorizeSSHKey returns the owner of the registered public key.
+func authorizeSSHKey(key ssh.PublicKey) (string, error) {
+	k, err := GetSSHKey(getSSHKeyID(key))
+	if err != nil {
+		return "", fmt.Errorf("unknown public key %s", ssh.FingerprintSHA256(key))
+	}
+	return k.Owner, nil
+}
+
+// resolveOwnedVM returns the IP address of the VM in its metadata if it's owned by the user.
+func resolveOwnedVM(owner, name string) (string, error) {
+	metaData, err := GetVM(name)
+	if err != nil || metaData.Owner != owner {
+		// don't tell the VM exists if it's not owned by the user
+		return "", fmt.Errorf("VM '%s' is not found", name)
+	}
+	if metaData.IPAddress == "" {
+		return "", fmt.Errorf("IP address of VM '%s' is unknown", name)
+	}
+	return metaData.IPAddress, nil
+}
+
+func (b *sshBastion) serve(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Println("[bastion] WARN listen temporary error: ", err.Error())
+				continue
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.handleConn(conn)
+		}()
+	}
+}
+
+func (b *sshBastion) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, b.config)
+	if err != nil {
+		log.Printf("[bastion] WARN handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	owner := sconn.Permissions.Extensions[sshBastionOwnerKey]
+	log.Printf("[bastion] INFO %s logged in from %s\n", owner, conn.RemoteAddr())
+
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only port forwarding is allowed")
+			continue
+		}
+		wg.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer wg.Done()
+			b.handleDirectTCPIP(owner, newChannel)
+		}(newChannel)
+	}
+}
+
+func (b *sshBastion) handleDirectTCPIP(owner string, newChannel ssh.NewChannel) {
+	var req directTCPIPRequest
+	err := ssh.Unmarshal(newChannel.ExtraData(), &req)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	ip, err := b.resolveVM(owner, req.Host)
+	if err != nil {
+		log.Printf("[bastion] WARN reject forwarding of %s to %s: %v\n", owner, req.Host, err)
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	dst, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(int(req.Port))), sshBastionDialTimeout)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer dst.Close()
+
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dst, ch)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(ch, dst)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// loadSSHHostKey reads the host key of the bastion, and generates it if it does not exist.
+func loadSSHHostKey(path string) (ssh.Signer, error) {
+	if !exists(path) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "loadSSHHostKey: failed to generate host key")
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loadSSHHostKey: failed to marshal host key")
+		}
+		b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		err = ioutil.WriteFile(path, b, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "loadSSHHostKey: failed to write host key")
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// ServeSSHBastion serves the SSH bastion to the VMs.
+func ServeSSHBastion() {
+	if C.SSHBastionPort == 0 {
+		return
+	}
+	hostKey, err := loadSSHHostKey(C.SSHHostKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", C.SSHBastionPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(newSSHBastion(hostKey, authorizeSSHKey, resolveOwnedVM).serve(ln))
+}
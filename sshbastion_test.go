@@ -0,0 +1,93 @@
+package minivmm
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generateTestSSHSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func TestSSHBastion(t *testing.T) {
+	echo := startTCPEchoServer(t, "127.0.0.1:0", "echo:")
+	defer echo.Close()
+	toPort := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	userKey := generateTestSSHSigner(t)
+	authorize := func(key ssh.PublicKey) (string, error) {
+		if getSSHKeyID(key) != getSSHKeyID(userKey.PublicKey()) {
+			return "", fmt.Errorf("unknown key")
+		}
+		return "user1", nil
+	}
+	resolveVM := func(owner, name string) (string, error) {
+		if owner != "user1" || name != "vm1" {
+			return "", fmt.Errorf("VM '%s' is not found", name)
+		}
+		return "127.0.0.1", nil
+	}
+	b := newSSHBastion(generateTestSSHSigner(t), authorize, resolveVM)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go b.serve(ln)
+
+	config := &ssh.ClientConfig{
+		User:            "user1",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         3 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", ln.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("vm1", toPort))
+	if err != nil {
+		t.Fatalf("failed to open direct-tcpip channel: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "hello\n")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "echo:hello\n" {
+		t.Errorf("unexpected reply; reply:%s err:%v", reply, err)
+	}
+
+	// VMs not owned by the user are not reachable
+	if _, err := client.Dial("tcp", net.JoinHostPort("vm2", toPort)); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+	// shell is not allowed
+	if _, err := client.NewSession(); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+
+	// unknown keys are rejected
+	config.Auth = []ssh.AuthMethod{ssh.PublicKeys(generateTestSSHSigner(t))}
+	if _, err := ssh.Dial("tcp", ln.Addr().String(), config); err == nil {
+		t.Errorf("expected error but it does not occur")
+	}
+}
@@ -0,0 +1,128 @@
+package minivmm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var validSSHKeyID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// SSHKeyMetaData is a public key to log in to the SSH bastion as the owner.
+type SSHKeyMetaData struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Owner       string `json:"owner"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// getSSHKeyID returns the ID of the public key, which is the hex encoded SHA256 hash of the wire format.
+func getSSHKeyID(key ssh.PublicKey) string {
+	h := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(h[:])
+}
+
+// AddSSHKey registers the public key in authorized_keys format.
+func AddSSHKey(k *SSHKeyMetaData) error {
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	if err != nil {
+		return errors.Wrap(err, "AddSSHKey: invalid public key")
+	}
+
+	k.ID = getSSHKeyID(key)
+	k.Fingerprint = ssh.FingerprintSHA256(key)
+	k.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if k.Name == "" {
+		k.Name = comment
+	}
+	if exists(getSSHKeyFilePath(k.ID)) {
+		return errors.Errorf("AddSSHKey: public key '%s' is already registered", k.Fingerprint)
+	}
+	return writeSSHKeyFile(k)
+}
+
+// RemoveSSHKey unregisters the public key.
+func RemoveSSHKey(id string) error {
+	recordPath := getSSHKeyFilePath(id)
+	err := os.Remove(recordPath)
+	if err != nil {
+		return err
+	}
+	// the lock file is left by WriteWithLock
+	err = os.Remove(recordPath + ".lock")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GetSSHKey returns the public key.
+func GetSSHKey(id string) (*SSHKeyMetaData, error) {
+	if !validSSHKeyID.MatchString(id) {
+		return nil, errors.Errorf("GetSSHKey: invalid key id '%s'", id)
+	}
+	k := SSHKeyMetaData{}
+	b, err := ioutil.ReadFile(getSSHKeyFilePath(id))
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(b, &k)
+	return &k, nil
+}
+
+// ListSSHKeys returns a list of registered public keys.
+func ListSSHKeys() ([]*SSHKeyMetaData, error) {
+	dirEntries, err := ioutil.ReadDir(C.SSHKeyDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "ListSSHKeys: Cannot read ssh key data dir")
+	}
+
+	var ret []*SSHKeyMetaData
+	for _, f := range dirEntries {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		k, err := GetSSHKey(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			log.Println("Ignore GetSSHKey error:", err)
+			continue
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+func getSSHKeyFilePath(id string) string {
+	return filepath.Join(C.SSHKeyDir, id+".json")
+}
+
+func writeSSHKeyFile(k *SSHKeyMetaData) error {
+	recordPath := getSSHKeyFilePath(k.ID)
+
+	f, err := os.OpenFile(recordPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	lockpath := recordPath + ".lock"
+	return WriteWithLock(f, lockpath, b)
+}
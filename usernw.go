@@ -0,0 +1,164 @@
+package minivmm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/apparentlymart/go-cidr/cidr"
+	"github.com/pkg/errors"
+)
+
+const (
+	// each user network is allocated a /24 subnet from VMM_USER_NETWORK_CIDR
+	userNetworkPrefixLen  = 24
+	userNetworkNamePrefix = "u-"
+)
+
+var userNetworkMutex sync.Mutex
+
+// getUserNetworkName returns the name of the owner's private network.
+// The owner name is hashed because it may contain characters not allowed in interface names.
+func getUserNetworkName(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return userNetworkNamePrefix + hex.EncodeToString(sum[:])[:8]
+}
+
+// allocateUserNetworkCIDR returns the first subnet in the pool which does not overlap with any networks.
+func allocateUserNetworkCIDR(nws []*NetworkMetaData) (string, error) {
+	_, pool, err := net.ParseCIDR(C.UserNetworkCIDR)
+	if err != nil {
+		return "", err
+	}
+	poolLen, _ := pool.Mask.Size()
+	if poolLen > userNetworkPrefixLen {
+		return "", fmt.Errorf("user network pool '%s' is smaller than '/%d'", C.UserNetworkCIDR, userNetworkPrefixLen)
+	}
+
+	used := []*net.IPNet{}
+	for _, nw := range nws {
+		_, n, err := net.ParseCIDR(nw.CIDR)
+		if err != nil {
+			continue
+		}
+		used = append(used, n)
+	}
+
+	for i := 0; i < 1<<uint(userNetworkPrefixLen-poolLen); i++ {
+		subnet, err := cidr.Subnet(pool, userNetworkPrefixLen-poolLen, i)
+		if err != nil {
+			return "", err
+		}
+		overlapped := false
+		for _, u := range used {
+			if isOverlapped(subnet, u) {
+				overlapped = true
+				break
+			}
+		}
+		if !overlapped {
+			return subnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("user network pool '%s' is exhausted", C.UserNetworkCIDR)
+}
+
+// ensureUserNetwork returns the owner's private network, creating it if it does not exist yet.
+func ensureUserNetwork(owner string) (*NetworkMetaData, error) {
+	name := getUserNetworkName(owner)
+	if nw, err := GetNetwork(name); err == nil {
+		if nw.Owner != owner || !nw.Private {
+			return nil, fmt.Errorf("network '%s' is not the user network of '%s'", name, owner)
+		}
+		return nw, nil
+	}
+
+	nws, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := allocateUserNetworkCIDR(nws)
+	if err != nil {
+		return nil, err
+	}
+
+	nw := &NetworkMetaData{
+		Name:    name,
+		Owner:   owner,
+		CIDR:    subnet,
+		NAT:     true,
+		Private: true,
+	}
+	err = createNetwork(nw)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Created user network '%s' (%s) for '%s'\n", name, subnet, owner)
+	return nw, nil
+}
+
+// assignNICNetwork resolves the network of the NIC created by the owner.
+// If user networks are enabled, the default network is replaced with the owner's private network.
+func assignNICNetwork(owner string, nic *NIC) error {
+	if nic.Network == "" {
+		nic.Network = DefaultNetworkName
+	}
+
+	if C.UserNetworks && nic.Network == DefaultNetworkName {
+		userNetworkMutex.Lock()
+		defer userNetworkMutex.Unlock()
+
+		nw, err := ensureUserNetwork(owner)
+		if err != nil {
+			return errors.Wrap(err, "Failed to prepare user network")
+		}
+		nic.Network = nw.Name
+		return nil
+	}
+
+	nw, err := GetNetwork(nic.Network)
+	if err != nil {
+		return fmt.Errorf("network '%s' does not exist", nic.Network)
+	}
+	if nw.Private && nw.Owner != owner {
+		return fmt.Errorf("network '%s' is a private network of another user", nic.Network)
+	}
+	return nil
+}
+
+// releaseUserNetwork removes the owner's private network if no VMs are connected to it.
+func releaseUserNetwork(owner string) error {
+	if !C.UserNetworks {
+		return nil
+	}
+
+	userNetworkMutex.Lock()
+	defer userNetworkMutex.Unlock()
+
+	name := getUserNetworkName(owner)
+	if _, err := GetNetwork(name); err != nil {
+		return nil
+	}
+
+	vms, err := ListVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		for _, nic := range vm.NICs {
+			if nic.Network == name {
+				return nil
+			}
+		}
+	}
+
+	err = RemoveNetwork(name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed user network '%s' of '%s'\n", name, owner)
+	return nil
+}
@@ -0,0 +1,46 @@
+package minivmm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUserNetworkHijack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minivmm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	SetConfig(&Config{NetworkDir: dir, UserNetworks: true, UserNetworkCIDR: "10.200.0.0/16"})
+
+	victimNetwork := getUserNetworkName("victim")
+	nw := &NetworkMetaData{Name: victimNetwork, Owner: "attacker", CIDR: "10.200.0.0/24", NAT: true}
+	if err := CreateNetwork(nw); err == nil {
+		t.Errorf("network with the user network prefix is created")
+	}
+
+	// pre-created network by others must not be used as the user network
+	cases := []*NetworkMetaData{
+		{Name: victimNetwork, Owner: "attacker", CIDR: "10.200.0.0/24", NAT: true, Private: true},
+		{Name: victimNetwork, Owner: "victim", CIDR: "10.200.0.0/24", NAT: true},
+	}
+	for _, c := range cases {
+		if err := writeNetworkFile(c); err != nil {
+			t.Fatalf("failed to write network file: %v", err)
+		}
+		if _, err := ensureUserNetwork("victim"); err == nil {
+			t.Errorf("network owned by '%s' (private:%v) is used as the user network", c.Owner, c.Private)
+		}
+	}
+
+	owned := &NetworkMetaData{Name: victimNetwork, Owner: "victim", CIDR: "10.200.0.0/24", NAT: true, Private: true}
+	writeNetworkFile(owned)
+	actual, err := ensureUserNetwork("victim")
+	if err != nil {
+		t.Fatalf("failed to get the user network: %v", err)
+	}
+	if actual.Name != victimNetwork {
+		t.Errorf("unexpected user network: %s", actual.Name)
+	}
+}
@@ -21,7 +21,9 @@ import (
 
 var (
 	qmpSocketFileName         = "qmp.socket"
+	vmMACVendor               = "52:54:00"
 	vncSocketFileName         = "vnc.socket"
+	serialSocketFileName      = "serial.socket"
 	vmMetaDataFileName        = "metadata.json"
 	cloudInitISOFileName      = "cloud-init.iso"
 	cloudInitUserDataFileName = "user-data"
@@ -32,40 +34,72 @@ var (
 
 var vmIFSetupScriptTemplate = `#!/bin/sh
 if_name=$1
-sudo ip link set dev $if_name netns minivmm
-sudo ip netns exec minivmm ip link set dev $if_name master br-minivmm
-sudo ip netns exec minivmm ip link set dev $if_name promisc on
-sudo ip netns exec minivmm ip link set dev $if_name up
+{{- if .Bridged}}
+sudo ip link set dev $if_name master {{.BrName}}
+sudo ip link set dev $if_name up
+{{- else}}
+sudo ip link set dev $if_name netns {{.NsName}}
+sudo ip netns exec {{.NsName}} ip link set dev $if_name master {{.BrName}}
+sudo ip netns exec {{.NsName}} ip link set dev $if_name promisc on
+sudo ip netns exec {{.NsName}} ip link set dev $if_name up
+{{- end}}
 `
 
 var vmIFCleanupScriptTemplate = `#!/bin/sh
 if_name=$1
-sudo ip netns exec minivmm ip link set dev $if_name down
-sudo ip netns exec minivmm ip link set dev $if_name promisc off
-sudo ip netns exec minivmm ip link set dev $if_name nomaster
-sudo ip netns exec minivmm ip link set dev $if_name netns 1
+{{- if .Bridged}}
+sudo ip link set dev $if_name down
+sudo ip link set dev $if_name nomaster
+{{- else}}
+sudo ip netns exec {{.NsName}} ip link set dev $if_name down
+sudo ip netns exec {{.NsName}} ip link set dev $if_name promisc off
+sudo ip netns exec {{.NsName}} ip link set dev $if_name nomaster
+sudo ip netns exec {{.NsName}} ip link set dev $if_name netns 1
+{{- end}}
 `
 
+type vmIFScriptParams struct {
+	NsName string
+	BrName string
+	// Bridged is true if the tap is attached to the host bridge instead of the bridge in netns.
+	Bridged bool
+}
+
 // VMMetaData is VM's metadata.
 type VMMetaData struct {
-	Name         string        `json:"name"`
-	Status       string        `json:"status"`
-	Owner        string        `json:"owner"`
-	Image        string        `json:"image"`
-	Arch         string        `json:"arch"`
-	Volume       string        `json:"volume"`
-	MacAddress   string        `json:"mac_address"`
-	IPAddress    string        `json:"ip_address"`
-	CPU          string        `json:"cpu"`
-	Memory       string        `json:"memory"`
-	Disk         string        `json:"disk"`
-	Tag          string        `json:"tag"`
-	Lock         bool          `json:"lock"`
-	VNCPassword  string        `json:"vnc_password"`
-	VNCPort      string        `json:"vnc_port"`
-	UserData     string        `json:"user_data"`
-	CloudInitIso string        `json:"cloud_init_iso"`
-	ExtraVolumes []ExtraVolume `json:"extra_volumes"`
+	Name           string        `json:"name"`
+	Status         string        `json:"status"`
+	Owner          string        `json:"owner"`
+	Image          string        `json:"image"`
+	Arch           string        `json:"arch"`
+	Volume         string        `json:"volume"`
+	MacAddress     string        `json:"mac_address"`
+	IPAddress      string        `json:"ip_address"`
+	IPv6Address    string        `json:"ipv6_address"`
+	CPU            string        `json:"cpu"`
+	Memory         string        `json:"memory"`
+	Disk           string        `json:"disk"`
+	Tag            string        `json:"tag"`
+	Lock           bool          `json:"lock"`
+	VNCPassword    string        `json:"vnc_password"`
+	VNCPort        string        `json:"vnc_port"`
+	UserData       string        `json:"user_data"`
+	CloudInitIso   string        `json:"cloud_init_iso"`
+	ExtraVolumes   []ExtraVolume `json:"extra_volumes"`
+	NICs           []NIC         `json:"nics"`
+	SecurityGroups []string      `json:"security_groups"`
+}
+
+// NIC is VM's network interface metadata.
+// The first NIC is the primary one, its addresses are also stored in VMMetaData.
+type NIC struct {
+	ID          string    `json:"id"`
+	Network     string    `json:"network"`
+	Model       string    `json:"model"`
+	MacAddress  string    `json:"mac_address"`
+	IPAddress   string    `json:"ip_address"`
+	IPv6Address string    `json:"ipv6_address"`
+	Limits      NICLimits `json:"limits"`
 }
 
 // ExtraVolume is extra volume's metadata
@@ -94,7 +128,7 @@ func cleanupVMIF(ifName string) error {
 
 func isExistsVMIF(ifName string) bool {
 	err := Execs([][]string{
-		{"sudo", "ip", "netns", "exec", "minivmm", "ip", "link", "show", "dev", ifName},
+		{"sudo", "ip", "netns", "exec", nsName, "ip", "link", "show", "dev", ifName},
 	})
 	if err == nil {
 		return true
@@ -123,13 +157,13 @@ func getMachineArch() (string, error) {
 		if int(val) == 0 {
 			continue
 		}
-		m += string(int(val))
+		m += string(rune(val))
 	}
 
 	return m, nil
 }
 
-func generateQemuParams(qmpSocketPath, vncSocketPath, driveFilePath, machineArch, cloudInitISOPath, vmMACAddr, vmIFName, cpu, memory string, extraVolumes []string) []string {
+func generateQemuParams(qmpSocketPath, vncSocketPath, qgaSocketPath, serialSocketPath, consoleLogPath, driveFilePath, machineArch, cloudInitISOPath, cpu, memory string, extraVolumes []string, nics []NIC, vmIFNames []string, vmIFFDs map[string]int) []string {
 	params := make([]string, 0, 32)
 
 	if !C.NoKvm {
@@ -152,46 +186,90 @@ func generateQemuParams(qmpSocketPath, vncSocketPath, driveFilePath, machineArch
 	}
 
 	params = append(params, "-cdrom", cloudInitISOPath)
-	params = append(params, "-net", fmt.Sprintf("nic,model=virtio,macaddr=%s", vmMACAddr))
-	params = append(params, "-net", fmt.Sprintf("tap,ifname=%s,script=/tmp/ifup,downscript=/tmp/ifdown", vmIFName))
+	for i, nic := range nics {
+		if fd, ok := vmIFFDs[nic.ID]; ok {
+			// macvtap is passed as an opened tap device
+			params = append(params, "-netdev", fmt.Sprintf("tap,id=%s,fd=%d", nic.ID, fd))
+		} else {
+			upScript, downScript := getVMIFScriptPaths(nic.Network)
+			params = append(params, "-netdev", fmt.Sprintf("tap,id=%s,ifname=%s,script=%s,downscript=%s", nic.ID, vmIFNames[i], upScript, downScript))
+		}
+		params = append(params, "-device", fmt.Sprintf("%s,id=%s,netdev=%s,mac=%s", nic.Model, getNICDeviceID(&nic), nic.ID, nic.MacAddress))
+	}
 	params = append(params, "-daemonize")
 	params = append(params, "-qmp", fmt.Sprintf("unix:%s,server,nowait", qmpSocketPath))
+	params = append(params, "-chardev", fmt.Sprintf("socket,id=qga0,path=%s,server,nowait", qgaSocketPath))
+	params = append(params, "-device", "virtio-serial")
+	params = append(params, "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+	// the serial output is also recorded in the console log even if nobody is connected
+	params = append(params, "-chardev", fmt.Sprintf("socket,id=serial0,path=%s,server,nowait,logfile=%s,logappend=on", serialSocketPath, consoleLogPath))
+	params = append(params, "-serial", "chardev:serial0")
 	params = append(params, "-m", memory, "-smp", fmt.Sprintf("cpus=%s", cpu))
-	params = append(params, "-vnc", fmt.Sprintf("unix:%s", vncSocketPath))
+	vncOpts := fmt.Sprintf("unix:%s", vncSocketPath)
+	if C.VNCPassword {
+		// the password is set via QMP after the VM is launched
+		vncOpts += ",password=on"
+	}
+	params = append(params, "-vnc", vncOpts)
 	params = append(params, "-k", envVNCKeyboardLayout)
 
 	return params
 }
 
 func generateMACAddress() string {
-	vendor := "52:54:00"
 	buf := make([]byte, 3)
 	rand.Read(buf)
-	return fmt.Sprintf("%s:%02x:%02x:%02x", vendor, buf[0], buf[1], buf[2])
+	return fmt.Sprintf("%s:%02x:%02x:%02x", vmMACVendor, buf[0], buf[1], buf[2])
+}
+
+// getVMIFName returns the tap interface name of the NIC.
+// The first NIC uses the same name as VMs created before multiple NICs support.
+func getVMIFName(name string, nic *NIC) string {
+	num := strings.TrimPrefix(nic.ID, "net")
+	if num == "0" {
+		return fmt.Sprintf("tap-%s", name)
+	}
+	return fmt.Sprintf("tap%s-%s", num, name)
+}
+
+func getVMIFScriptPaths(network string) (string, string) {
+	return "/tmp/ifup-" + network, "/tmp/ifdown-" + network
+}
+
+func getVMIFScriptParams(network string) (*vmIFScriptParams, error) {
+	nw, err := GetNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if isBridgedNetwork(nw) {
+		return &vmIFScriptParams{BrName: nw.HostInterface, Bridged: true}, nil
+	}
+	br, _ := getNetworkIFNames(nw)
+	return &vmIFScriptParams{NsName: nsName, BrName: br}, nil
 }
 
-func generateVMIFSetupScript(path string) error {
+func generateVMIFSetupScript(path string, params *vmIFScriptParams) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	t := template.Must(template.New("ifscript").Parse(vmIFSetupScriptTemplate))
-	err = t.Execute(f, nil)
+	err = t.Execute(f, params)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func generateVMIFCleanupScript(path string) error {
+func generateVMIFCleanupScript(path string, params *vmIFScriptParams) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	t := template.Must(template.New("ifscript").Parse(vmIFCleanupScriptTemplate))
-	err = t.Execute(f, nil)
+	err = t.Execute(f, params)
 	if err != nil {
 		return err
 	}
@@ -222,6 +300,11 @@ func getVNCSocketPath(name string) string {
 	return filepath.Join(C.VMDir, name, vncSocketFileName)
 }
 
+// GetSerialSocketPath returns the path of the unix socket connected to the serial console of the VM.
+func GetSerialSocketPath(name string) string {
+	return filepath.Join(C.VMDir, name, serialSocketFileName)
+}
+
 func generateRandomPassword() (string, error) {
 	b := make([]byte, 8)
 	_, err := rand.Read(b)
@@ -256,6 +339,22 @@ func GetVncPort(name string) (string, error) {
 	return port, nil
 }
 
+// setVNCPassword sets the password of the VNC server of the specified VM.
+func setVNCPassword(name, password string) error {
+	q, _, err := initQMP(getQMPSocketPath(name))
+	if err != nil {
+		return errors.Wrap(err, "QMP connection failed")
+	}
+	defer q.Shutdown()
+
+	_, err = q.ExecuteRawCommand(context.Background(), "change-vnc-password", map[string]interface{}{"password": password}, nil)
+	if err != nil {
+		return errors.Wrap(err, "change-vnc-password command failed")
+	}
+
+	return nil
+}
+
 func saveVMMetaData(name string, metaData *VMMetaData) error {
 	metaDataByte, err := json.Marshal(metaData)
 	if err != nil {
@@ -289,6 +388,24 @@ func loadVMMetaData(name string) (*VMMetaData, error) {
 		return nil, err
 	}
 	json.Unmarshal(metaDataByte, &vmMetaData)
+
+	// VMs created before multiple networks support have only one NIC on the default network
+	if len(vmMetaData.NICs) == 0 && vmMetaData.MacAddress != "" {
+		vmMetaData.NICs = []NIC{{
+			Network:     DefaultNetworkName,
+			MacAddress:  vmMetaData.MacAddress,
+			IPAddress:   vmMetaData.IPAddress,
+			IPv6Address: vmMetaData.IPv6Address,
+		}}
+	}
+	for i := range vmMetaData.NICs {
+		if vmMetaData.NICs[i].ID == "" {
+			vmMetaData.NICs[i].ID = fmt.Sprintf("net%d", i)
+		}
+		if vmMetaData.NICs[i].Model == "" {
+			vmMetaData.NICs[i].Model = defaultNICModel
+		}
+	}
 	return &vmMetaData, nil
 }
 
@@ -320,20 +437,53 @@ func createCloudInitISO(cloudInitFilesPath, isoPath, name, userData string) erro
 }
 
 // CreateVM creates new VM and starts it.
-func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (ret *VMMetaData, retErr error) {
+// If no NICs are given, the VM will have a NIC on the default network.
+// The security groups are applied before the VM starts.
+func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string, nics []NIC, securityGroups []string) (ret *VMMetaData, retErr error) {
 	if exists(filepath.Join(C.VMDir, name, vmMetaDataFileName)) {
 		return nil, errors.Errorf("CreateVM: VM '%s' already exists", name)
 	}
+	err := validateVMSecurityGroups(owner, securityGroups)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateVM")
+	}
 
+	// the user network may be allocated by assignNICNetwork even if a later step fails
 	defer func() {
 		if retErr != nil && name != "" {
 			rmErr := os.RemoveAll(filepath.Join(C.VMDir, name))
 			if rmErr != nil {
 				log.Println("Ignore RemoveAll error:", rmErr)
 			}
+			if relErr := releaseUserNetwork(owner); relErr != nil {
+				log.Println("Ignore releaseUserNetwork error:", relErr)
+			}
 		}
 	}()
 
+	if len(nics) == 0 {
+		nics = []NIC{{Network: DefaultNetworkName}}
+	}
+	newNICs := []NIC{}
+	for _, nic := range nics {
+		err := assignNICNetwork(owner, &nic)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+		n, err := prepareNIC(nic, newNICs)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+		newNICs = append(newNICs, *n)
+	}
+	nics = newNICs
+	if len(securityGroups) > 0 {
+		err = validateSecurityGroupNICs(nics)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM")
+		}
+	}
+
 	vmDataDir := filepath.Join(C.VMDir, name)
 	driveFilePath, err := CreateImage(name, disk, imageName, vmDataDir)
 	if err != nil {
@@ -348,7 +498,6 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 		return nil, err
 	}
 
-	vmMACAddr := generateMACAddress()
 	password, _ := generateRandomPassword()
 
 	machineArch, err := getMachineArch()
@@ -358,26 +507,34 @@ func CreateVM(name, owner, imageName, cpu, memory, disk, userData, tag string) (
 	}
 
 	metaData := &VMMetaData{
-		Name:         name,
-		Owner:        owner,
-		Image:        imageName,
-		Arch:         machineArch,
-		Volume:       driveFilePath,
-		MacAddress:   vmMACAddr,
-		CPU:          cpu,
-		Memory:       memory,
-		Disk:         disk,
-		Tag:          tag,
-		Lock:         false,
-		VNCPassword:  password,
-		VNCPort:      "",
-		UserData:     userData,
-		CloudInitIso: isoFilePath,
+		Name:           name,
+		Owner:          owner,
+		Image:          imageName,
+		Arch:           machineArch,
+		Volume:         driveFilePath,
+		MacAddress:     nics[0].MacAddress,
+		CPU:            cpu,
+		Memory:         memory,
+		Disk:           disk,
+		Tag:            tag,
+		Lock:           false,
+		VNCPassword:    password,
+		VNCPort:        "",
+		UserData:       userData,
+		CloudInitIso:   isoFilePath,
+		NICs:           nics,
+		SecurityGroups: securityGroups,
 	}
 	err = saveVMMetaData(name, metaData)
 	if err != nil {
 		return nil, err
 	}
+	if len(securityGroups) > 0 {
+		err = ApplySecurityGroups()
+		if err != nil {
+			return nil, errors.Wrap(err, "CreateVM: Failed to apply security groups")
+		}
+	}
 
 	metaData, err = StartVM(name)
 	if err != nil {
@@ -421,17 +578,19 @@ func StopVM(name string) error {
 	return nil
 }
 
-func prepareStartVM(name string, metaData *VMMetaData) ([]string, error) {
+func prepareStartVM(name string, metaData *VMMetaData) ([]string, []*os.File, error) {
 	qmpSocketPath := getQMPSocketPath(name)
 	vncSocketPath := getVNCSocketPath(name)
+	qgaSocketPath := getQGASocketPath(name)
+	serialSocketPath := GetSerialSocketPath(name)
+	consoleLogPath := getConsoleLogPath(name)
 	driveFilePath := metaData.Volume
 	machineArch := metaData.Arch
 	cloudInitISOPath := metaData.CloudInitIso
-	vmMACAddr := metaData.MacAddress
 	cpu := metaData.CPU
 	memory, err := convertSIPrefixedValue(metaData.Memory, "mebi")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	extraVolumes := []string{}
 	if metaData.ExtraVolumes != nil {
@@ -439,22 +598,47 @@ func prepareStartVM(name string, metaData *VMMetaData) ([]string, error) {
 			extraVolumes = append(extraVolumes, vol.Path)
 		}
 	}
-	vmIFName := fmt.Sprintf("tap-%s", name)
-	prepareVMIF(vmIFName)
-	qemuParams := generateQemuParams(qmpSocketPath, vncSocketPath, driveFilePath, machineArch, cloudInitISOPath, vmMACAddr, vmIFName, cpu, memory, extraVolumes)
+	vmIFNames := []string{}
+	vmIFFDs := map[string]int{}
+	fds := []*os.File{}
+	for i := range metaData.NICs {
+		nic := &metaData.NICs[i]
+		vmIFName := getVMIFName(name, nic)
+		vmIFNames = append(vmIFNames, vmIFName)
+
+		nw, err := GetNetwork(nic.Network)
+		if err == nil && nw.Mode == NetworkModeMacvtap {
+			f, err := prepareMacvtap(vmIFName, nw.HostInterface, nic.MacAddress)
+			if err != nil {
+				closeFiles(fds)
+				return nil, nil, errors.Wrap(err, "StartVM: macvtap setup failed")
+			}
+			// extra files start from fd 3 in the child process
+			vmIFFDs[nic.ID] = 3 + len(fds)
+			fds = append(fds, f)
+			continue
+		}
+		prepareVMIF(vmIFName)
+	}
+	qemuParams := generateQemuParams(qmpSocketPath, vncSocketPath, qgaSocketPath, serialSocketPath, consoleLogPath, driveFilePath, machineArch, cloudInitISOPath, cpu, memory, extraVolumes, metaData.NICs, vmIFNames, vmIFFDs)
 
 	log.Println("Prepare if script ...")
-	err = generateVMIFSetupScript("/tmp/ifup")
-	if err != nil {
-		return nil, errors.Wrap(err, "StartVM: VM interface setup script generate failed")
-	}
-	err = generateVMIFCleanupScript("/tmp/ifdown")
-	if err != nil {
-		return nil, errors.Wrap(err, "StartVM: VM interface setup script generate failed")
+	for _, nic := range metaData.NICs {
+		err = prepareVMIFScripts(nic.Network)
+		if err != nil {
+			closeFiles(fds)
+			return nil, nil, errors.Wrap(err, "StartVM")
+		}
 	}
 
 	log.Println("Launching vm with: ", driveFilePath, qmpSocketFileName, qemuParams)
-	return qemuParams, nil
+	return qemuParams, fds, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
 }
 
 // StartVM starts VM.
@@ -470,13 +654,40 @@ func StartVM(name string) (*VMMetaData, error) {
 	}
 
 	qemuBinaryName := "qemu-system-" + metaData.Arch
-	qemuParams, err := prepareStartVM(name, metaData)
-	stdErr, err := qemu.LaunchCustomQemu(context.Background(), qemuBinaryName, qemuParams, nil, nil, nil)
+	qemuParams, fds, err := prepareStartVM(name, metaData)
+	if err != nil {
+		return nil, err
+	}
+	stdErr, err := qemu.LaunchCustomQemu(context.Background(), qemuBinaryName, qemuParams, fds, nil, nil)
+	// qemu holds its own copies of the tap devices
+	closeFiles(fds)
 	if err != nil {
 		log.Println(stdErr)
 		return nil, errors.Wrap(err, "StartVM: VM launch failed")
 	}
 
+	for i := range metaData.NICs {
+		err = applyNICLimits(name, &metaData.NICs[i])
+		if err != nil {
+			log.Println("Ignore applyNICLimits error:", err)
+		}
+	}
+
+	if C.VNCPassword {
+		// VMs created by older versions may not have the password
+		if metaData.VNCPassword == "" {
+			metaData.VNCPassword, _ = generateRandomPassword()
+			err = saveVMMetaData(name, metaData)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = setVNCPassword(name, metaData.VNCPassword)
+		if err != nil {
+			return nil, errors.Wrap(err, "StartVM")
+		}
+	}
+
 	port, err := GetVncPort(name)
 	if err != nil {
 		return nil, err
@@ -641,8 +852,10 @@ func GetVMFromMac(mac string) (*VMMetaData, error) {
 	}
 
 	for _, metaData := range metaDataList {
-		if metaData.MacAddress == mac {
-			return metaData, nil
+		for _, nic := range metaData.NICs {
+			if nic.MacAddress == mac {
+				return metaData, nil
+			}
 		}
 	}
 
@@ -681,14 +894,50 @@ func UpdateIPAddress() {
 			continue
 		}
 
-		e.IPAddress = r.IPAddress
+		isPrimary := false
+		changed := false
+		for i := range e.NICs {
+			if e.NICs[i].MacAddress != r.MacAddress {
+				continue
+			}
+			current, current6 := e.NICs[i].IPAddress, e.NICs[i].IPv6Address
+			e.NICs[i].IPAddress = r.IPAddress
+			e.NICs[i].IPv6Address = r.IPv6Address
+			if e.NICs[i].IPv6Address == "" {
+				e.NICs[i].IPv6Address = getVMIPv6Address(e.Name, e.NICs[i].Network, r.MacAddress, current6)
+			}
+			if e.NICs[i].IPAddress != current || e.NICs[i].IPv6Address != current6 {
+				changed = true
+			}
+			if i == 0 {
+				isPrimary = true
+				e.IPAddress = e.NICs[i].IPAddress
+				e.IPv6Address = e.NICs[i].IPv6Address
+			}
+		}
 		err = saveVMMetaData(e.Name, e)
 		if err != nil {
 			log.Println("Ignore saveVMMetaData error:", err)
 			continue
 		}
 
-		UpdateIPAddressInForwarder(e.Name, r.IPAddress)
+		if isPrimary {
+			UpdateIPAddressInForwarder(e.Name, r.IPAddress)
+		}
+		if !changed {
+			continue
+		}
+		// security groups of any VM may refer the VM's address
+		vms, err := ListVMs()
+		if err != nil {
+			log.Println("Ignore ListVMs error:", err)
+			continue
+		}
+		if securityGroupsUsed(vms) {
+			if err := ApplySecurityGroups(); err != nil {
+				log.Println("Ignore ApplySecurityGroups error:", err)
+			}
+		}
 	}
 }
 
@@ -707,8 +956,16 @@ func RemoveVM(name string) error {
 		return err
 	}
 
-	vmIFName := fmt.Sprintf("tap-%s", name)
-	if isExistsVMIF(vmIFName) {
+	err = removeForwardsToVM(name)
+	if err != nil {
+		return errors.Wrap(err, "RemoveVM: Failed to remove forwards")
+	}
+
+	for i := range metaData.NICs {
+		vmIFName := getVMIFName(name, &metaData.NICs[i])
+		if !isExistsVMIF(vmIFName) {
+			continue
+		}
 		retryCount := 0
 		for {
 			if retryCount > 30 {
@@ -725,5 +982,16 @@ func RemoveVM(name string) error {
 
 	vmDataDir := filepath.Join(C.VMDir, name)
 	err = os.RemoveAll(vmDataDir)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if len(metaData.SecurityGroups) > 0 {
+		err = ApplySecurityGroups()
+		if err != nil {
+			return err
+		}
+	}
+
+	return releaseUserNetwork(metaData.Owner)
 }
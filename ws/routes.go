@@ -10,4 +10,8 @@ import (
 func RegisterHandlers(mux *http.ServeMux) {
 	server := websocket.Server{Handshake: HandshakeWsVNC, Handler: websocket.Handler(HandleWsVNC)}
 	mux.Handle("/ws/vnc", server)
+	tunnelServer := websocket.Server{Handshake: HandshakeWsTunnel, Handler: websocket.Handler(HandleWsTunnel)}
+	mux.Handle("/ws/tunnel", tunnelServer)
+	serialServer := websocket.Server{Handshake: HandshakeWsSerial, Handler: websocket.Handler(HandleWsSerial)}
+	mux.Handle("/ws/serial", serialServer)
 }
@@ -0,0 +1,84 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+	"minivmm"
+)
+
+// HandleWsSerial proxies between websocket and the serial console of the VM.
+func HandleWsSerial(wsconn *websocket.Conn) {
+	defer wsconn.Close()
+
+	// get the destination VM name
+	vmName := wsconn.Request().URL.Query().Get("name")
+
+	// connect to serial socket
+	serialconn, err := net.Dial("unix", minivmm.GetSerialSocketPath(vmName))
+	if err != nil {
+		log.Printf("failed to open serial socket: %v\n", err)
+		return
+	}
+	defer serialconn.Close()
+
+	wsconn.PayloadType = websocket.BinaryFrame
+
+	// proxy between websocket and serial console
+	done := make(chan struct{})
+	go func() {
+		io.Copy(wsconn, serialconn)
+		wsconn.Close()
+		serialconn.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(serialconn, wsconn)
+		wsconn.Close()
+		serialconn.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	log.Printf("ws serial disconnected name=%s\n", vmName)
+}
+
+// HandshakeWsSerial checks parameters and authorizes the websocket serial console request.
+func HandshakeWsSerial(config *websocket.Config, r *http.Request) error {
+	err := handshakeWsSerial(config, r)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func handshakeWsSerial(config *websocket.Config, r *http.Request) error {
+	vmName := r.URL.Query().Get("name")
+	if vmName == "" {
+		return fmt.Errorf("missing query parameter 'name'")
+	}
+	log.Printf("ws serial connect query name=%s\n", vmName)
+
+	_, err := authorizeWsConsole(r, vmName)
+	if err != nil {
+		return err
+	}
+
+	// terminal clients like xterm.js may not request any sub protocol, and it must not be answered then
+	protocols := config.Protocol
+	config.Protocol = nil
+	for _, p := range protocols {
+		if p == "binary" {
+			config.Protocol = []string{"binary"}
+		}
+	}
+
+	log.Printf("ws serial connected name=%s\n", vmName)
+	return nil
+}
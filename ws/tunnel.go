@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"minivmm"
+)
+
+const tunnelDialTimeout = 10 * time.Second
+
+// HandleWsTunnel proxies between websocket and the TCP port of the VM.
+func HandleWsTunnel(wsconn *websocket.Conn) {
+	defer wsconn.Close()
+
+	// get the destination VM name and port
+	vmName := wsconn.Request().URL.Query().Get("name")
+	port := wsconn.Request().URL.Query().Get("port")
+
+	vmMetaData, err := minivmm.GetVM(vmName)
+	if err != nil {
+		log.Printf("failed to get VM metadata: %v\n", err)
+		return
+	}
+	if vmMetaData.IPAddress == "" {
+		log.Printf("IP address of VM '%s' is unknown\n", vmName)
+		return
+	}
+
+	// connect to the VM
+	dstconn, err := net.DialTimeout("tcp", net.JoinHostPort(vmMetaData.IPAddress, port), tunnelDialTimeout)
+	if err != nil {
+		log.Printf("failed to connect to VM: %v\n", err)
+		return
+	}
+	defer dstconn.Close()
+
+	wsconn.PayloadType = websocket.BinaryFrame
+
+	// proxy between websocket and the VM
+	done := make(chan struct{})
+	go func() {
+		io.Copy(wsconn, dstconn)
+		wsconn.Close()
+		dstconn.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(dstconn, wsconn)
+		wsconn.Close()
+		dstconn.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	log.Printf("ws tunnel disconnected name=%s port=%s\n", vmName, port)
+}
+
+// HandshakeWsTunnel checks parameters and authorizes the websocket tunnel request.
+func HandshakeWsTunnel(config *websocket.Config, r *http.Request) error {
+	err := handshakeWsTunnel(config, r)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func handshakeWsTunnel(config *websocket.Config, r *http.Request) error {
+	vmName := r.URL.Query().Get("name")
+	if vmName == "" {
+		return fmt.Errorf("missing query parameter 'name'")
+	}
+	port := r.URL.Query().Get("port")
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid query parameter 'port'")
+	}
+	log.Printf("ws tunnel connect query name=%s port=%s\n", vmName, port)
+
+	// the console token is required not to let other sites open the tunnel with the user's cookie
+	_, err := authorizeWsConsole(r, vmName)
+	if err != nil {
+		return err
+	}
+
+	config.Protocol = []string{"binary"}
+
+	log.Printf("ws tunnel connected name=%s port=%s\n", vmName, port)
+	return nil
+}
@@ -68,33 +68,33 @@ func handshakeWsVNC(config *websocket.Config, r *http.Request) error {
 	}
 	log.Printf("ws connect query name=%s\n", vmName)
 
-	vmMetaData, err := minivmm.GetVM(vmName)
+	_, err := authorizeWsConsole(r, vmName)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("no such a VM named '%s'", vmName))
+		return err
 	}
 
 	config.Protocol = []string{"binary"}
 
-	if !minivmm.C.NoAuth {
-		// get access token
-		cookie, err := r.Cookie(minivmm.CookieName)
-		if err != nil {
-			return errors.Wrap(err, "failed to get the access token from cookie")
-		}
-		token := cookie.Value
-
-		// verify token
-		payload, err := minivmm.VerifyToken(token)
-		if err != nil {
-			return errors.Wrap(err, "failed to verify the access token")
-		}
-
-		// check ownership for VM
-		if vmMetaData.Owner != payload.Subject {
-			return fmt.Errorf("forbidden")
-		}
-	}
-
 	log.Printf("ws connected name=%s\n", vmName)
 	return nil
 }
+
+// authorizeWsConsole checks the console token in query parameter, which is issued by the console API.
+// The token is required even if the authentication is disabled not to expose the console to anyone.
+func authorizeWsConsole(r *http.Request, vmName string) (*minivmm.VMMetaData, error) {
+	vmMetaData, err := minivmm.GetVM(vmName)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("no such a VM named '%s'", vmName))
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return nil, fmt.Errorf("missing query parameter 'token'")
+	}
+	err = minivmm.ConsumeConsoleToken(token, vmName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify the console token")
+	}
+
+	return vmMetaData, nil
+}